@@ -0,0 +1,233 @@
+package shandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	// AccessLogNone disables the access log
+	AccessLogNone = "none"
+	// AccessLogCombined is the Apache combined log format
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes one JSON object per request
+	AccessLogJSON = "json"
+	// AccessLogTemplate formats requests with a text/template
+	AccessLogTemplate = "template"
+)
+
+// AccessLogEntry describes a request that has been served.
+// Its fields can be used in access log templates, such as
+// {{.Method}} {{.URI}} {{.Status}} {{.Duration}}
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Route      string        `json:"route"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+}
+
+// MarshalJSON writes the duration in milliseconds
+func (e AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type entry AccessLogEntry
+	return json.Marshal(struct {
+		entry
+		DurationMS float64 `json:"duration_ms"`
+	}{entry(e), float64(e.Duration.Microseconds()) / 1000})
+}
+
+// AccessLogger writes an access log entry for every request
+type AccessLogger struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	format  string
+	tmpl    *template.Template
+	sample  float64
+	exclude []string
+}
+
+// NewAccessLogger returns an AccessLogger that writes the access_log_*
+// settings of c to w. It returns nil when the access log is disabled.
+func NewAccessLogger(w io.Writer, c Config) (*AccessLogger, error) {
+	a := &AccessLogger{
+		w:       w,
+		format:  c.AccessLogFormat,
+		sample:  c.AccessLogSampleRatio,
+		exclude: c.AccessLogExclude,
+	}
+
+	switch c.AccessLogFormat {
+	case AccessLogNone:
+		return nil, nil
+	case AccessLogCombined, AccessLogJSON:
+	case AccessLogTemplate:
+		t, err := template.New("access_log").Parse(c.AccessLogTemplate)
+		if err != nil {
+			return nil, err
+		}
+		a.tmpl = t
+	default:
+		return nil, errors.New("unknown access log format " + c.AccessLogFormat)
+	}
+	return a, nil
+}
+
+// excluded returns true when path matches one of the exclusions.
+// An exclusion that ends with * matches every path with that prefix.
+func (a *AccessLogger) excluded(path string) bool {
+	for _, e := range a.exclude {
+		if strings.HasSuffix(e, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(e, "*")) {
+				return true
+			}
+		} else if path == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled decides whether a request is logged. Failed requests are
+// always logged, so that sampling never hides errors.
+func (a *AccessLogger) sampled(status int) bool {
+	if status >= http.StatusBadRequest || a.sample >= 1 {
+		return true
+	}
+	return rand.Float64() < a.sample
+}
+
+// combined formats e in the Apache combined log format
+func combined(e AccessLogEntry) string {
+	dash := func(s string) string {
+		if s == empty {
+			return "-"
+		}
+		return s
+	}
+
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	return dash(e.RemoteAddr) + " - " + dash(e.User) + " [" +
+		e.Time.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto) + " " +
+		strconv.Itoa(e.Status) + " " + size + " " +
+		strconv.Quote(dash(e.Referer)) + " " + strconv.Quote(dash(e.UserAgent))
+}
+
+// Log writes e unless it is excluded or not sampled
+func (a *AccessLogger) Log(e AccessLogEntry) {
+	path := strings.SplitN(e.URI, "?", 2)[0]
+	if a.excluded(path) || !a.sampled(e.Status) {
+		return
+	}
+
+	var buf bytes.Buffer
+	switch a.format {
+	case AccessLogCombined:
+		buf.WriteString(combined(e))
+	case AccessLogJSON:
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		buf.Write(data)
+	case AccessLogTemplate:
+		err := a.tmpl.Execute(&buf, e)
+		if err != nil {
+			return
+		}
+	}
+	buf.WriteByte('\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.w.Write(buf.Bytes())
+}
+
+// accessLogger is the AccessLogger of MiddleWare, nil when disabled.
+// It is replaced when the configuration is reloaded.
+var accessLogger atomic.Pointer[AccessLogger]
+
+func init() {
+	a, _ := NewAccessLogger(os.Stdout, DefaultConfig())
+	accessLogger.Store(a)
+}
+
+// SetAccessLogger replaces the AccessLogger of MiddleWare.
+// A nil AccessLogger disables the access log.
+func SetAccessLogger(a *AccessLogger) {
+	accessLogger.Store(a)
+}
+
+// requestUser returns the authenticated user of r
+func requestUser(r *http.Request) string {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return empty
+	}
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	return info.user
+}
+
+// MiddleWare writes an access log entry when a request has been served
+func MiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := accessLogger.Load()
+		if a == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		a.Log(AccessLogEntry{
+			Time:       start,
+			RemoteAddr: host,
+			User:       requestUser(r),
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Route:      routeTemplate(r),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Duration:   time.Since(start),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  RequestID(r.Context()),
+		})
+	})
+}
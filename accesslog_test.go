@@ -0,0 +1,109 @@
+package shandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// accessLog writes the access log of the requests that follow to the
+// returned buffer, with the access_log settings of c
+func accessLog(t *testing.T, c Config) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	a, err := NewAccessLogger(&buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := accessLogger.Load()
+	SetAccessLogger(a)
+	t.Cleanup(func() { SetAccessLogger(old) })
+	return &buf
+}
+
+// accessLogEntries returns the entries of a JSON access log
+func accessLogEntries(t *testing.T, buf *bytes.Buffer) []AccessLogEntry {
+	t.Helper()
+	entries := []AccessLogEntry{}
+	d := json.NewDecoder(buf)
+	for d.More() {
+		var e AccessLogEntry
+		err := d.Decode(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLogExclude(t *testing.T) {
+	h := newTestServer(t)
+	c := DefaultConfig()
+	c.AccessLogFormat = AccessLogJSON
+	c.AccessLogExclude = []string{"/healthz", "/v1/username/*"}
+	buf := accessLog(t, c)
+
+	for _, path := range []string{"/healthz", "/healthz?verbose=1", "/v1/username/1", "/readyz", "/v1/time"} {
+		serve(h, http.MethodGet, path, empty)
+	}
+	rw := serve(h, http.MethodGet, "/v3/users/1", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+
+	entries := accessLogEntries(t, buf)
+	if len(entries) != 3 || entries[0].URI != "/readyz" || entries[1].URI != "/v1/time" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	e := entries[2]
+	if e.Method != http.MethodGet || e.Route != "/v3/users/{id:[0-9]+}" || e.Status != http.StatusOK ||
+		e.User != "admin" || e.RequestID == empty || e.Bytes == 0 {
+		t.Fatalf("entry = %+v", e)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	h := newTestServer(t)
+	c := DefaultConfig()
+	c.AccessLogFormat = AccessLogJSON
+	c.AccessLogSampleRatio = 0
+	c.AccessLogExclude = nil
+	buf := accessLog(t, c)
+
+	// Failed requests are logged whatever the sample ratio
+	for i := 0; i < 10; i++ {
+		serve(h, http.MethodGet, "/v1/time", empty)
+	}
+	serve(h, http.MethodGet, "/v3/users/1", empty)
+	serve(h, http.MethodGet, "/v1/nothing", empty)
+
+	entries := accessLogEntries(t, buf)
+	if len(entries) != 2 || entries[0].Status != http.StatusUnauthorized || entries[1].Status != http.StatusNotFound {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	h := newTestServer(t)
+	c := DefaultConfig()
+	buf := accessLog(t, c)
+	serve(h, http.MethodGet, "/v1/time?x=1", empty, "User-Agent", "tester")
+	line := buf.String()
+	if !strings.Contains(line, `"GET /v1/time?x=1 HTTP/1.1" 200 `) || !strings.HasSuffix(line, `"-" "tester"`+"\n") {
+		t.Fatalf("combined = %q", line)
+	}
+
+	c.AccessLogFormat = AccessLogTemplate
+	c.AccessLogTemplate = `{{.Method}} {{.Route}} {{.Status}}`
+	buf = accessLog(t, c)
+	serve(h, http.MethodGet, "/v1/username/1", empty)
+	if buf.String() != "GET /v1/username/{id:[0-9]+} 200\n" {
+		t.Fatalf("template = %q", buf.String())
+	}
+
+	c.AccessLogFormat = AccessLogNone
+	if a, err := NewAccessLogger(buf, c); a != nil || err != nil {
+		t.Fatalf("NewAccessLogger = %v, %v", a, err)
+	}
+}
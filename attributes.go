@@ -0,0 +1,193 @@
+package shandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// DefaultAttributesSchema is the JSON Schema of the user attributes when
+// attributes_schema is not set: a display name, a department, a phone
+// number and free-form metadata
+const DefaultAttributesSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "properties": {
+    "display_name": {"type": "string", "maxLength": 100},
+    "department": {"type": "string", "maxLength": 100},
+    "phone": {"type": "string", "pattern": "^\\+?[0-9 ()./-]{3,32}$"},
+    "metadata": {"type": "object"}
+  },
+  "additionalProperties": false
+}`
+
+// AttributesSchema is a compiled JSON Schema of the user attributes
+type AttributesSchema struct {
+	raw    json.RawMessage
+	schema *jsonschema.Schema
+}
+
+// CompileAttributesSchema compiles the JSON Schema in data
+func CompileAttributesSchema(data []byte) (*AttributesSchema, error) {
+	return compileAttributesSchema("attributes.json", data)
+}
+
+// compileAttributesSchema compiles data as the schema at url,
+// which relative references are resolved against
+func compileAttributesSchema(url string, data []byte) (*AttributesSchema, error) {
+	raw := bytes.Buffer{}
+	err := json.Compact(&raw, data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	err = c.AddResource(url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.Compile(url)
+	if err != nil {
+		return nil, err
+	}
+	return &AttributesSchema{raw: raw.Bytes(), schema: s}, nil
+}
+
+// LoadAttributesSchema compiles the JSON Schema file at path,
+// or DefaultAttributesSchema when path is empty
+func LoadAttributesSchema(path string) (*AttributesSchema, error) {
+	if path == empty {
+		return CompileAttributesSchema([]byte(DefaultAttributesSchema))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileAttributesSchema(abs, data)
+}
+
+// Validate returns a ValidationError with every part of attributes that
+// s rejects, or nil. Attributes are always a JSON object.
+func (s *AttributesSchema) Validate(attributes json.RawMessage) error {
+	d := json.NewDecoder(bytes.NewReader(attributes))
+	d.UseNumber()
+	var v interface{}
+	err := d.Decode(&v)
+	if _, ok := v.(map[string]interface{}); err != nil || !ok {
+		return ValidationError{{Field: "attributes", Rule: "type", Message: "must be a JSON object"}}
+	}
+
+	err = s.schema.Validate(v)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	violations := ValidationError{}
+	for _, e := range schemaLeaves(ve) {
+		field := "attributes" + strings.ReplaceAll(e.InstanceLocation, "/", ".")
+		rule := e.KeywordLocation[strings.LastIndex(e.KeywordLocation, "/")+1:]
+		violations = append(violations, Violation{Field: field, Rule: rule, Message: e.Message})
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Field < violations[j].Field
+	})
+	return violations
+}
+
+// schemaLeaves returns the errors of e that have no causes,
+// which are the ones that describe what is wrong
+func schemaLeaves(e *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(e.Causes) == 0 {
+		return []*jsonschema.ValidationError{e}
+	}
+	leaves := []*jsonschema.ValidationError{}
+	for _, c := range e.Causes {
+		leaves = append(leaves, schemaLeaves(c)...)
+	}
+	return leaves
+}
+
+// attributesSchema is the AttributesSchema of the server
+var attributesSchema atomic.Pointer[AttributesSchema]
+
+func init() {
+	s, err := LoadAttributesSchema(empty)
+	if err != nil {
+		panic(err)
+	}
+	SetAttributesSchema(s)
+}
+
+// SetAttributesSchema replaces the AttributesSchema of the server.
+// The users that are stored are not checked again.
+func SetAttributesSchema(s *AttributesSchema) {
+	attributesSchema.Store(s)
+}
+
+// validateAttributes checks attributes against the AttributesSchema of
+// the server. Empty attributes have not been set and are not checked.
+func validateAttributes(attributes json.RawMessage) error {
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributesSchema.Load().Validate(attributes)
+}
+
+// storedAttributes returns the form of attributes that is stored,
+// compact JSON with {} for attributes that have not been set
+func storedAttributes(attributes json.RawMessage) (string, error) {
+	if len(attributes) == 0 {
+		return "{}", nil
+	}
+	b := bytes.Buffer{}
+	err := json.Compact(&b, attributes)
+	return b.String(), err
+}
+
+// attributeNamePattern is the format of the names in attribute filters
+var attributeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// attributePath turns a filter name, such as metadata.team, into the
+// SQLite JSON path of the attribute
+func attributePath(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		if !attributeNamePattern.MatchString(p) {
+			return empty, errors.New("invalid attribute name " + name)
+		}
+		parts[i] = `"` + p + `"`
+	}
+	return "$." + strings.Join(parts, "."), nil
+}
+
+// swagger:route GET /v3/users/attributes-schema users getAttributesSchemaV3
+// Get the JSON Schema of the user attributes
+//
+// responses:
+//	200: OK
+//	401: V3Error
+
+// AttributesSchemaHandlerV3 returns the JSON Schema that the attributes
+// of users follow
+func AttributesSchemaHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	if _, ok := requireUser(rw, r); !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, attributesSchema.Load().raw)
+}
@@ -0,0 +1,99 @@
+package shandler
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","attributes":{"department":"Sales","phone":"555-0100"}}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"attributes":{"phone":null}}`,
+		"Authorization", adminAuth, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusOK)
+	var v UserView
+	decodeBody(t, rw, &v)
+	if string(v.Attributes) != `{"department":"Sales"}` {
+		t.Fatalf("attributes = %s", v.Attributes)
+	}
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"attributes":{"phone":42}}`,
+		"Authorization", adminAuth, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusUnprocessableEntity)
+
+	rw = serve(h, http.MethodGet, "/v3/users?attributes.department=Sales", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	var users []UserView
+	decodeBody(t, rw, &users)
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Fatalf("users = %+v", users)
+	}
+}
+
+func TestV1UserDataHasNoAttributes(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","attributes":{"phone":"555-0100"}}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodGet, "/v1/username/2", empty)
+	expectStatus(t, rw, http.StatusOK)
+	var v map[string]interface{}
+	decodeBody(t, rw, &v)
+	if hasKey(v, "attributes") || strings.Contains(rw.Body.String(), "555-0100") {
+		t.Fatalf("user = %v", v)
+	}
+}
+
+func TestExportAttributes(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","attributes":{"department":"Sales"}}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodGet, "/v3/users/export?format=csv", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	records, err := csv.NewReader(rw.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0][len(records[0])-1] != "attributes" {
+		t.Fatalf("records = %q", records)
+	}
+	if records[1][8] != "{}" || records[2][8] != `{"department":"Sales"}` {
+		t.Fatalf("records = %q", records)
+	}
+}
+
+func TestFindUsersAttributeTypes(t *testing.T) {
+	h := newTestServer(t)
+	for _, body := range []string{
+		`{"user":"alice","password":"alice-secret","attributes":{"metadata":{"remote":true,"level":3}}}`,
+		`{"user":"bob","password":"bob-secret","attributes":{"metadata":{"remote":false,"level":1}}}`,
+		`{"user":"carol","password":"carol-secret","attributes":{"metadata":{"remote":"1"}}}`,
+	} {
+		rw := serve(h, http.MethodPost, "/v3/users", body, "Authorization", adminAuth)
+		expectStatus(t, rw, http.StatusCreated)
+	}
+
+	tests := map[string]string{
+		"attributes.metadata.remote=true":  "alice",
+		"attributes.metadata.remote=false": "bob",
+		"attributes.metadata.remote=1":     "carol",
+		"attributes.metadata.level=3":      "alice",
+	}
+	for query, want := range tests {
+		rw := serve(h, http.MethodGet, "/v3/users?"+query, empty, "Authorization", adminAuth)
+		expectStatus(t, rw, http.StatusOK)
+		var users []UserView
+		decodeBody(t, rw, &users)
+		if len(users) != 1 || users[0].Username != want {
+			t.Fatalf("%s: users = %+v, want %s", query, users, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package shandler
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// AuditPasswordChanged is recorded when a user changes their password
+	AuditPasswordChanged = "password_changed"
+	// AuditPasswordChangeFailed is recorded when a password change
+	// is refused because the current password is wrong
+	AuditPasswordChangeFailed = "password_change_failed"
+	// AuditPasswordResetRequested is recorded when a password reset
+	// token is sent to a user
+	AuditPasswordResetRequested = "password_reset_requested"
+	// AuditPasswordResetLimited is recorded when a password reset is not
+	// sent because the account has asked for too many
+	AuditPasswordResetLimited = "password_reset_limited"
+	// AuditPasswordReset is recorded when a user sets a new password
+	// with a password reset token
+	AuditPasswordReset = "password_reset"
+	// AuditEmailVerificationRequested is recorded when an email
+	// verification token is sent to a user
+	AuditEmailVerificationRequested = "email_verification_requested"
+	// AuditEmailVerified is recorded when a user confirms an email address
+	AuditEmailVerified = "email_verified"
+)
+
+var auditEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "shandler_audit_events_total",
+	Help: "Number of audit events by event.",
+}, []string{"event"})
+
+func init() {
+	Registry.MustRegister(auditEvents)
+}
+
+// audit records a security event of the request of ctx. Audit events are
+// log records with audit=true, so that they can be kept apart from the
+// rest of the log, and carry the request ID and the user of the request.
+func audit(ctx context.Context, event string, args ...any) {
+	auditEvents.WithLabelValues(event).Inc()
+	logger(ctx).Info("audit event", append([]any{"audit", true, "event", event}, args...)...)
+}
@@ -0,0 +1,102 @@
+package shandler
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// BackupDatabase writes a consistent copy of the database to path.
+// It uses VACUUM INTO, so it is safe to run while the server is running.
+func BackupDatabase(path string) error {
+	defer observeQuery("backup")()
+
+	_, err := os.Stat(path)
+	if err == nil {
+		return errors.New(path + " already exists")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("backing up database", "database", SQLFILE, "to", path)
+	_, err = db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// checkDatabase verifies that path is a SQLite3 database with a users table
+func checkDatabase(path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New("integrity check failed: " + result)
+	}
+
+	var count int
+	return db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+}
+
+// RestoreDatabase replaces the database with the backup at path and
+// applies the migrations the backup is missing. The backup is checked
+// before anything is replaced. The server should not be running.
+func RestoreDatabase(path string) error {
+	err := checkDatabase(path)
+	if err != nil {
+		return errors.New(path + " is not a valid backup: " + err.Error())
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(SQLFILE), filepath.Base(SQLFILE)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("restoring database", "database", SQLFILE, "from", path)
+	err = CloseDatabase()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), SQLFILE)
+	if err != nil {
+		return err
+	}
+
+	if !Migrate() {
+		return errors.New("cannot migrate " + SQLFILE)
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package shandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// BATCHLIMIT defines the maximum number of operations of a batch request
+var BATCHLIMIT = 500
+
+const (
+	// BatchAtomic executes all operations of a batch or none of them
+	BatchAtomic = "atomic"
+	// BatchIndependent commits every operation of a batch that succeeds
+	BatchIndependent = "independent"
+)
+
+// BatchRequest defines the body of POST /v3/users/batch
+// swagger:model BatchRequest
+type BatchRequest struct {
+	// Either atomic (the default) or independent
+	//
+	// required: false
+	Mode string `json:"mode"`
+	// The operations to execute in order
+	//
+	// required: true
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation defines a single operation of a BatchRequest
+// swagger:model BatchOperation
+type BatchOperation struct {
+	// One of create, update and delete
+	//
+	// required: true
+	Op string `json:"op"`
+	// The ID of the user for update and delete
+	//
+	// required: false
+	ID int `json:"id,omitempty"`
+	// The ETag the user must have for update and delete
+	//
+	// required: false
+	IfMatch string `json:"ifmatch,omitempty"`
+	// An Input record for create, a JSON Merge Patch for update
+	//
+	// required: false
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+// BatchResult defines the result of a single BatchOperation
+// swagger:model BatchResult
+type BatchResult struct {
+	// The position of the operation in the request
+	//
+	// required: true
+	Index int `json:"index"`
+	// The operation
+	//
+	// required: true
+	Op string `json:"op"`
+	// The HTTP status code of the operation
+	//
+	// required: true
+	Status int `json:"status"`
+	// The user record after the operation
+	//
+	// required: false
+	User *UserView `json:"user,omitempty"`
+	// Description of the error
+	//
+	// required: false
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResponse defines the body returned by POST /v3/users/batch
+// swagger:model BatchResponse
+type BatchResponse struct {
+	// The mode of the batch
+	//
+	// required: true
+	Mode string `json:"mode"`
+	// Whether the changes have been saved
+	//
+	// required: true
+	Committed bool `json:"committed"`
+	// The results in the order of the operations
+	//
+	// required: true
+	Results []BatchResult `json:"results"`
+}
+
+// batchFailure returns a failed BatchResult
+func batchFailure(status int, msg string) BatchResult {
+	return BatchResult{Status: status, Error: msg}
+}
+
+// batchError logs err, which the client must not see, and returns a
+// failed BatchResult with a generic message
+func batchError(ctx context.Context, err error) BatchResult {
+	logger(ctx).Error("cannot execute batch operation", "err", err)
+	return batchFailure(http.StatusInternalServerError, "cannot execute operation")
+}
+
+// batchUser returns a successful BatchResult with the user defined by ID
+func batchUser(ctx context.Context, q execer, status int, ID int) BatchResult {
+	u, err := execFindUser(q, "ID", ID)
+	if err != nil {
+		return batchError(ctx, err)
+	}
+	view := u.View()
+	return BatchResult{Status: status, User: &view}
+}
+
+// batchPassword is the password that a BatchOperation sets and its hash
+type batchPassword struct {
+	plain string
+	hash  string
+}
+
+// hashOf returns the hash of password, which is the one of p
+// when p has been hashed already
+func (p batchPassword) hashOf(password string) (string, error) {
+	if p.hash != empty && p.plain == password {
+		return p.hash, nil
+	}
+	return HashPassword(password)
+}
+
+// hashBatchPasswords hashes the passwords that ops set, so that bcrypt does
+// not run while the transaction of the batch holds the database. Passwords
+// that cannot be hashed are left to the operations, which reject them.
+func hashBatchPasswords(ctx context.Context, ops []BatchOperation) ([]batchPassword, error) {
+	passwords := make([]batchPassword, len(ops))
+	for i, op := range ops {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var in struct {
+			Password *string `json:"password"`
+		}
+		if op.Op != "create" && op.Op != "update" {
+			continue
+		}
+		if json.Unmarshal(op.User, &in) != nil || in.Password == nil || *in.Password == empty {
+			continue
+		}
+		h, err := HashPassword(*in.Password)
+		if err == nil {
+			passwords[i] = batchPassword{plain: *in.Password, hash: h}
+		}
+	}
+	return passwords, nil
+}
+
+// execBatchOperation executes a single BatchOperation of caller using q,
+// with the password of the operation that hashBatchPasswords hashed.
+// It returns the password change of an update, nil when there is none.
+func execBatchOperation(ctx context.Context, q execer, caller User, op BatchOperation, password batchPassword) (BatchResult, *passwordChange) {
+	exists := func(field, value string) bool {
+		if field == "email" {
+			u, err := execFindUser(q, "Email", normalizeEmail(value))
+			return err == nil && u.ID != op.ID
+		}
+		_, err := execFindUser(q, "Username", value)
+		return err == nil
+	}
+
+	if op.Op == "create" {
+		var in = userCreateBody{}
+		err := decodeStrict(bytes.NewReader(op.User), &in)
+		if err != nil {
+			return batchFailure(bodyErrorStatus(err), err.Error()), nil
+		}
+		err = checkWritable(caller.Role(), in.fields())
+		if err != nil {
+			return batchFailure(http.StatusForbidden, err.Error()), nil
+		}
+		err = in.Validate()
+		if err != nil {
+			return batchFailure(http.StatusUnprocessableEntity, err.Error()), nil
+		}
+		if exists("user", in.Username) {
+			return batchFailure(http.StatusConflict, "user already exists"), nil
+		}
+		if in.Email != empty && exists("email", in.Email) {
+			return batchFailure(http.StatusConflict, "email already exists"), nil
+		}
+
+		u := in.NewUser()
+		u.Password, err = password.hashOf(u.Password)
+		if err != nil {
+			return batchError(ctx, err), nil
+		}
+		id, err := execInsertUser(q, u)
+		if err != nil {
+			return batchError(ctx, err), nil
+		}
+		return batchUser(ctx, q, http.StatusCreated, id), nil
+	}
+
+	if op.Op != "update" && op.Op != "delete" {
+		return batchFailure(http.StatusBadRequest, "unknown operation "+strconv.Quote(op.Op)), nil
+	}
+
+	t, err := execFindUser(q, "ID", op.ID)
+	if err == ErrUserNotFound {
+		return batchFailure(http.StatusNotFound, "user not found"), nil
+	} else if err != nil {
+		return batchError(ctx, err), nil
+	}
+
+	version, status := matchETag(op.IfMatch, t)
+	if status == http.StatusPreconditionRequired {
+		return batchFailure(status, "ifmatch required"), nil
+	} else if status != 0 {
+		return batchFailure(status, "user record has been modified"), nil
+	}
+
+	if op.Op == "delete" {
+		err = execDeleteUser(q, t.ID, version)
+		if err != nil {
+			return batchError(ctx, err), nil
+		}
+		return BatchResult{Status: http.StatusNoContent}, nil
+	}
+
+	changed, err := PatchUserDocument(t, MergePatchType, op.User)
+	if err != nil {
+		return batchFailure(http.StatusUnprocessableEntity, err.Error()), nil
+	}
+	err = checkWritable(caller.Role(), changedFields(changed))
+	if err != nil {
+		return batchFailure(http.StatusForbidden, err.Error()), nil
+	}
+	update, err := newUserUpdate(changed)
+	if err != nil {
+		return batchFailure(http.StatusUnprocessableEntity, err.Error()), nil
+	}
+
+	fields, status, msg := applyUserChanges(&t, update, exists)
+	if status != 0 {
+		return batchFailure(status, msg), nil
+	}
+	err = validateChanges(t, fields)
+	if err != nil {
+		return batchFailure(http.StatusUnprocessableEntity, err.Error()), nil
+	}
+
+	_, newPassword := changed["password"]
+	if newPassword {
+		t.Password, err = password.hashOf(t.Password)
+		if err != nil {
+			return batchError(ctx, err), nil
+		}
+	}
+	if len(fields) != 0 {
+		err = execUpdateUser(q, t, fields, version)
+		if err != nil {
+			return batchError(ctx, err), nil
+		}
+	}
+	if !newPassword {
+		return batchUser(ctx, q, http.StatusOK, t.ID), nil
+	}
+
+	// A new password logs the user out, as with PATCH
+	revoked, err := execRevokeCredentials(q, t.ID)
+	if err != nil {
+		return batchError(ctx, err), nil
+	}
+	return batchUser(ctx, q, http.StatusOK, t.ID), &passwordChange{t.ID, revoked}
+}
+
+// ExecuteBatch executes ops in a single database transaction.
+// In BatchAtomic mode the first failure rolls back the transaction.
+// In BatchIndependent mode every operation runs in its own savepoint,
+// so a failure only discards the changes of that operation.
+// It returns a result per operation and whether the transaction was committed.
+// The operations have the permissions of an administrator.
+func ExecuteBatch(ops []BatchOperation, mode string) ([]BatchResult, bool, error) {
+	return ExecuteBatchContext(context.Background(), ops, mode)
+}
+
+// ExecuteBatchContext is like ExecuteBatch, with ctx for tracing and cancellation
+func ExecuteBatchContext(ctx context.Context, ops []BatchOperation, mode string) ([]BatchResult, bool, error) {
+	return executeBatch(ctx, User{ID: -1, Admin: 1}, ops, mode)
+}
+
+// executeBatch implements ExecuteBatchContext for the operations of caller,
+// whose role decides the fields that they can write
+func executeBatch(ctx context.Context, caller User, ops []BatchOperation, mode string) ([]BatchResult, bool, error) {
+	ctx, end := startOperation(ctx, "ExecuteBatch", "batch")
+	defer end()
+
+	passwords, err := hashBatchPasswords(ctx, ops)
+	if err != nil {
+		return nil, false, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	results := make([]BatchResult, len(ops))
+	changes := []passwordChange{}
+	for i, op := range ops {
+		if mode == BatchIndependent {
+			_, err = tx.Exec("SAVEPOINT operation")
+			if err != nil {
+				tx.Rollback()
+				return nil, false, err
+			}
+		}
+
+		res, change := execBatchOperation(ctx, tx, caller, op, passwords[i])
+		res.Index = i
+		res.Op = op.Op
+		results[i] = res
+		failed := res.Error != empty
+		if !failed && change != nil {
+			changes = append(changes, *change)
+		}
+
+		if mode != BatchIndependent {
+			if !failed {
+				continue
+			}
+
+			logger(ctx).Info("batch operation failed", "index", i, "err", res.Error)
+			tx.Rollback()
+			for j := range results {
+				if j == i {
+					continue
+				}
+				msg := "rolled back"
+				if j > i {
+					msg = "not executed"
+				}
+				results[j] = BatchResult{Index: j, Op: ops[j].Op, Status: http.StatusFailedDependency, Error: msg}
+			}
+			return results, false, nil
+		}
+
+		if failed {
+			logger(ctx).Info("batch operation failed", "index", i, "err", res.Error)
+			_, err = tx.Exec("ROLLBACK TO operation")
+			if err != nil {
+				tx.Rollback()
+				return nil, false, err
+			}
+		}
+		_, err = tx.Exec("RELEASE operation")
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, c := range changes {
+		audit(ctx, AuditPasswordChanged, "user_id", c.userID, "by", caller.ID,
+			"sessions_revoked", c.revoked, "source", "batch")
+	}
+	return results, true, nil
+}
+
+// swagger:route POST /v3/users/batch users batchUsersV3
+// Create, update and delete users in a single transaction
+//
+// responses:
+//	200: BatchResponse
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+//	413: V3Error
+
+// BatchHandlerV3 executes a BatchRequest and requires an administrator.
+// When an atomic batch fails, the status code of the failed operation is returned.
+func BatchHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireAdmin(rw, r)
+	if !ok {
+		return
+	}
+
+	var batch = BatchRequest{}
+	err := decodeJSON(r, &batch)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	if batch.Mode == empty {
+		batch.Mode = BatchAtomic
+	}
+	if batch.Mode != BatchAtomic && batch.Mode != BatchIndependent {
+		writeError(rw, http.StatusBadRequest, "mode must be atomic or independent")
+		return
+	}
+
+	if len(batch.Operations) == 0 {
+		writeError(rw, http.StatusBadRequest, "no operations")
+		return
+	}
+	if len(batch.Operations) > BATCHLIMIT {
+		writeError(rw, http.StatusRequestEntityTooLarge, "too many operations, the limit is "+strconv.Itoa(BATCHLIMIT))
+		return
+	}
+
+	results, committed, err := executeBatch(r.Context(), caller, batch.Operations, batch.Mode)
+	if err != nil {
+		logger(r.Context()).Error("cannot execute batch", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot execute batch")
+		return
+	}
+
+	status := http.StatusOK
+	if !committed {
+		for _, res := range results {
+			if res.Status != http.StatusFailedDependency {
+				status = res.Status
+			}
+		}
+	}
+	writeJSON(rw, status, BatchResponse{Mode: batch.Mode, Committed: committed, Results: results})
+}
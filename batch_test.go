@@ -0,0 +1,175 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBatchAtomic(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"operations":[
+		{"op":"create","user":{"user":"alice","password":"alice-secret"}},
+		{"op":"update","id":1,"user":{"password":"admin-secret"}},
+		{"op":"create","user":{"user":"bob","password":"bob-secret"}}
+	]}`
+	rw := serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	var res BatchResponse
+	decodeBody(t, rw, &res)
+	if !res.Committed || len(res.Results) != 3 || res.Results[0].Status != http.StatusCreated {
+		t.Fatalf("response = %+v", res)
+	}
+	expectNoPassword(t, rw)
+
+	for _, u := range []UserPass{{"alice", "alice-secret"}, {"admin", "admin-secret"}, {"bob", "bob-secret"}} {
+		if _, ok := AuthenticateContext(context.Background(), u); !ok {
+			t.Fatalf("%s cannot log in", u.Username)
+		}
+	}
+
+	body = `{"operations":[
+		{"op":"create","user":{"user":"carol","password":"carol-secret"}},
+		{"op":"create","user":{"user":"alice","password":"alice-secret"}},
+		{"op":"delete","id":2}
+	]}`
+	rw = serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", basicAuth("admin", "admin-secret"))
+	expectStatus(t, rw, http.StatusConflict)
+	decodeBody(t, rw, &res)
+	if res.Committed || res.Results[0].Error != "rolled back" || res.Results[2].Error != "not executed" {
+		t.Fatalf("response = %+v", res)
+	}
+	if FindUserUsername("carol").Username != empty {
+		t.Fatal("a failed atomic batch was committed")
+	}
+}
+
+func TestBatchIndependent(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"mode":"independent","operations":[
+		{"op":"create","user":{"user":"alice","password":"alice-secret"}},
+		{"op":"create","user":{"user":"alice","password":"alice-secret"}},
+		{"op":"update","id":42,"user":{"admin":1}}
+	]}`
+	rw := serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	var res BatchResponse
+	decodeBody(t, rw, &res)
+	want := []int{http.StatusCreated, http.StatusConflict, http.StatusNotFound}
+	for i, status := range want {
+		if res.Results[i].Status != status {
+			t.Fatalf("result %d = %+v, want status %d", i, res.Results[i], status)
+		}
+	}
+	if !res.Committed || FindUserUsername("alice").Username == empty {
+		t.Fatalf("response = %+v", res)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	h := newTestServer(t)
+	defer func(limit int) { BATCHLIMIT = limit }(BATCHLIMIT)
+	BATCHLIMIT = 2
+
+	ops := strings.Repeat(`{"op":"delete","id":2},`, 3)
+	rw := serve(h, http.MethodPost, "/v3/users/batch", `{"operations":[`+strings.TrimSuffix(ops, ",")+`]}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusRequestEntityTooLarge)
+
+	rw = serve(h, http.MethodPost, "/v3/users/batch", `{"operations":[]}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusBadRequest)
+}
+
+func TestHashBatchPasswords(t *testing.T) {
+	ops := []BatchOperation{
+		{Op: "create", User: []byte(`{"user":"alice","password":"alice-secret"}`)},
+		{Op: "update", ID: 1, User: []byte(`{"password":"admin-secret"}`)},
+		{Op: "update", ID: 1, User: []byte(`{"admin":1}`)},
+		{Op: "delete", ID: 1},
+	}
+	passwords, err := hashBatchPasswords(context.Background(), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(passwords[0].hash, "alice-secret") || !CheckPassword(passwords[1].hash, "admin-secret") {
+		t.Fatalf("passwords = %+v", passwords)
+	}
+	if passwords[2].hash != empty || passwords[3].hash != empty {
+		t.Fatalf("passwords = %+v", passwords)
+	}
+
+	// A hash is only used for the password it belongs to
+	h, err := passwords[0].hashOf("other-secret")
+	if err != nil || !CheckPassword(h, "other-secret") {
+		t.Fatal("the hash of another password was used")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = hashBatchPasswords(ctx, ops)
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+	c := DefaultConfig()
+	timeouts := NewTimeouts(c.HandlerTimeout.Duration, c.HandlerTimeouts)
+	r := mux.NewRouter()
+	var got time.Duration
+	r.HandleFunc("/v3/users/batch", func(rw http.ResponseWriter, r *http.Request) {
+		got = timeouts.timeout(r)
+	}).Methods(http.MethodPost)
+	serve(r, http.MethodPost, "/v3/users/batch", `{}`)
+	if got <= c.HandlerTimeout.Duration {
+		t.Fatalf("batch timeout = %s, want more than %s", got, c.HandlerTimeout)
+	}
+}
+
+func TestBatchDatabaseErrors(t *testing.T) {
+	h := newTestServer(t)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TRIGGER broken BEFORE INSERT ON users BEGIN SELECT RAISE(ABORT, 'disk is broken'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+
+	body := `{"mode":"independent","operations":[{"op":"create","user":{"user":"alice","password":"alice-secret"}}]}`
+	rw := serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", adminAuth, "X-Request-ID", "batch-1")
+	expectStatus(t, rw, http.StatusOK)
+	var res BatchResponse
+	decodeBody(t, rw, &res)
+	if res.Results[0].Status != http.StatusInternalServerError || strings.Contains(res.Results[0].Error, "broken") {
+		t.Fatalf("results = %+v", res.Results)
+	}
+	if !strings.Contains(logs.String(), "disk is broken") || !strings.Contains(logs.String(), "batch-1") {
+		t.Fatalf("the error was not logged with the request ID: %s", logs)
+	}
+}
+
+func TestBatchPasswordChangeAudit(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	login(t, h, "alice", "alice-secret")
+	logs := captureLogs(t)
+
+	body := `{"operations":[{"op":"update","id":2,"ifmatch":"*","user":{"password":"alice-secret-2"}}]}`
+	rw = serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	for _, want := range []string{`"event":"password_changed"`, `"user_id":2`, `"sessions_revoked":1`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("%s is not in the logs: %s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package shandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// BodyLimit overrides the maximum body size of the requests that match
+// Route and Method, which work as in RateLimitRule. A zero MaxBytes
+// removes the limit.
+type BodyLimit struct {
+	Route    string `yaml:"route" toml:"route"`
+	Method   string `yaml:"method,omitempty" toml:"method,omitempty"`
+	MaxBytes int    `yaml:"max_bytes" toml:"max_bytes"`
+}
+
+// validate returns the problems of b
+func (b BodyLimit) validate() error {
+	if b.Route == empty {
+		return errors.New("route is required")
+	}
+	if b.MaxBytes < 0 {
+		return errors.New("max_bytes cannot be negative")
+	}
+	return nil
+}
+
+// BodyLimits defines how large request bodies can be
+type BodyLimits struct {
+	def    int
+	routes []BodyLimit
+}
+
+// NewBodyLimits returns BodyLimits with a default maximum size and the
+// limits of specific routes, the first matching BodyLimit applies
+func NewBodyLimits(def int, routes []BodyLimit) *BodyLimits {
+	return &BodyLimits{def: def, routes: routes}
+}
+
+// limit returns the maximum body size of r, zero when there is none
+func (b *BodyLimits) limit(r *http.Request) int64 {
+	route := routeTemplate(r)
+	for _, l := range b.routes {
+		if matchRoute(l.Route, l.Method, r.Method, route, r.URL.Path) {
+			return int64(l.MaxBytes)
+		}
+	}
+	return int64(b.def)
+}
+
+// bodyLimits are the BodyLimits of BodyLimitMiddleWare, nil when disabled
+var bodyLimits atomic.Pointer[BodyLimits]
+
+func init() {
+	c := DefaultConfig()
+	bodyLimits.Store(NewBodyLimits(c.MaxBodyBytes, c.BodyLimits))
+}
+
+// SetBodyLimits replaces the BodyLimits of BodyLimitMiddleWare.
+// Nil BodyLimits remove every limit.
+func SetBodyLimits(b *BodyLimits) {
+	bodyLimits.Store(b)
+}
+
+// BodyLimitMiddleWare rejects the requests whose body is larger than their
+// limit with 413 Request Entity Too Large. Bodies without a Content-Length
+// fail when a handler reads past the limit, so they are never buffered
+// completely.
+func BodyLimitMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b := bodyLimits.Load()
+		if b == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		limit := b.limit(r)
+		if limit <= 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			logger(r.Context()).Info("request body too large", "size", r.ContentLength, "limit", limit)
+			writeError(rw, http.StatusRequestEntityTooLarge,
+				"request body is larger than "+strconv.FormatInt(limit, 10)+" bytes")
+			return
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, limit)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// bodyError is a problem of a request body and the status that reports it
+type bodyError struct {
+	status int
+	msg    string
+}
+
+// Error implements error
+func (e *bodyError) Error() string {
+	return e.msg
+}
+
+// jsonType returns the JSON name of the kind of t
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// fieldPath writes the dotted path of encoding/json, such as 1.admin,
+// with brackets for the array indexes: [1].admin
+func fieldPath(field string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if b.Len() != 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// describeJSONError turns an error of encoding/json into a bodyError
+// that names the problem and, when there is one, the field
+func describeJSONError(err error) *bodyError {
+	var maxBytes *http.MaxBytesError
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytes):
+		return &bodyError{http.StatusRequestEntityTooLarge,
+			"request body is larger than " + strconv.FormatInt(maxBytes.Limit, 10) + " bytes"}
+	case errors.Is(err, io.EOF):
+		return &bodyError{http.StatusBadRequest, "request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &bodyError{http.StatusBadRequest, "request body is incomplete JSON"}
+	case errors.As(err, &syntax):
+		return &bodyError{http.StatusBadRequest,
+			fmt.Sprintf("invalid JSON at byte %d: %s", syntax.Offset, strings.TrimPrefix(syntax.Error(), "json: "))}
+	case errors.As(err, &typ):
+		if typ.Field == empty {
+			return &bodyError{http.StatusBadRequest,
+				"request body must be " + jsonType(typ.Type) + ", not " + typ.Value}
+		}
+		return &bodyError{http.StatusBadRequest,
+			"field " + strconv.Quote(fieldPath(typ.Field)) + " must be " + jsonType(typ.Type) + ", not " + typ.Value}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return &bodyError{http.StatusBadRequest, "unknown field " + field}
+	}
+	return &bodyError{http.StatusBadRequest, "cannot read request body"}
+}
+
+// decodeJSON decodes the JSON body of r into v. The Content-Type must be
+// JSON when it is set, fields that v does not have are errors and the body
+// must hold a single JSON value. The errors are *bodyError values.
+func decodeJSON(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != empty {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return &bodyError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+		}
+	}
+	return decodeStrict(r.Body, v)
+}
+
+// decodeStrict decodes the JSON in r into v like decodeJSON, for the
+// JSON documents that are part of a body. The errors are *bodyError values.
+func decodeStrict(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	err := d.Decode(v)
+	if err != nil {
+		return describeJSONError(err)
+	}
+
+	_, err = d.Token()
+	if err != io.EOF {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return describeJSONError(err)
+		}
+		return &bodyError{http.StatusBadRequest, "request body must hold a single JSON value"}
+	}
+	return nil
+}
+
+// bodyErrorStatus returns the HTTP status of err, which decodeJSON returned
+func bodyErrorStatus(err error) int {
+	var b *bodyError
+	if errors.As(err, &b) {
+		return b.status
+	}
+	return http.StatusBadRequest
+}
+
+// writeBodyError logs err, which decodeJSON returned, and writes it in the
+// plain text of the v1 and v2 handlers
+func writeBodyError(rw http.ResponseWriter, r *http.Request, err error) {
+	logger(r.Context()).Info("invalid request body", "err", err)
+	rw.WriteHeader(bodyErrorStatus(err))
+	fmt.Fprintf(rw, "%s\n", err)
+}
@@ -0,0 +1,81 @@
+package shandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimits(t *testing.T) {
+	h := newTestServer(t)
+	SetBodyLimits(NewBodyLimits(64, []BodyLimit{{Route: "/v3/users/batch", Method: http.MethodPost, MaxBytes: 0}}))
+	t.Cleanup(func() {
+		c := DefaultConfig()
+		SetBodyLimits(NewBodyLimits(c.MaxBodyBytes, c.BodyLimits))
+	})
+
+	large := `{"user":"alice","password":"` + strings.Repeat("a", 100) + `"}`
+	rw := serve(h, http.MethodPost, "/v3/sessions", large)
+	expectStatus(t, rw, http.StatusRequestEntityTooLarge)
+
+	// Without Content-Length the limit applies while the body is read
+	r := httptest.NewRequest(http.MethodPatch, "/v3/users/1", strings.NewReader(large))
+	r.ContentLength = -1
+	r.Header.Set("Authorization", adminAuth)
+	r.Header.Set("Content-Type", MergePatchType)
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	expectStatus(t, rw, http.StatusRequestEntityTooLarge)
+
+	// Zero removes the limit of the route
+	ops := strings.Repeat(`{"op":"delete","id":42},`, 10)
+	rw = serve(h, http.MethodPost, "/v3/users/batch", `{"mode":"independent","operations":[`+strings.TrimSuffix(ops, ",")+`]}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+}
+
+func TestStrictDecoding(t *testing.T) {
+	h := newTestServer(t)
+
+	requests := []struct {
+		method, path, body, contentType string
+		status                          int
+		msg                             string
+	}{
+		{http.MethodPost, "/v3/sessions", `{"user":"admin","password":"admin","remember":true}`, empty,
+			http.StatusBadRequest, `unknown field "remember"`},
+		{http.MethodPost, "/v3/sessions", `{"user":"admin","password":"admin"} {}`, empty,
+			http.StatusBadRequest, "single JSON value"},
+		{http.MethodPost, "/v3/sessions", `user=admin`, "application/x-www-form-urlencoded",
+			http.StatusUnsupportedMediaType, "Content-Type"},
+		{http.MethodPost, "/v3/users/batch", `{"operations":[],"atomic":true}`, empty,
+			http.StatusBadRequest, `unknown field "atomic"`},
+		{http.MethodPost, "/v3/users/batch", `{"operations":"all"}`, empty,
+			http.StatusBadRequest, `field "operations" must be an array`},
+		{http.MethodPatch, "/v3/users/1", `{"admin":1} {"admin":0}`, MergePatchType,
+			http.StatusBadRequest, "single JSON value"},
+		{http.MethodPatch, "/v3/users/1", `{"admin":`, MergePatchType,
+			http.StatusBadRequest, "incomplete JSON"},
+		{http.MethodPatch, "/v3/users/1", `[{"op":1}]`, JSONPatchType,
+			http.StatusBadRequest, `field "[0].op" must be a string`},
+	}
+	for _, r := range requests {
+		header := []string{"Authorization", adminAuth}
+		if r.contentType != empty {
+			header = append(header, "Content-Type", r.contentType)
+		}
+		rw := serve(h, r.method, r.path, r.body, header...)
+		var e V3Error
+		decodeBody(t, rw, &e)
+		if rw.Code != r.status || !strings.Contains(e.Error, r.msg) {
+			t.Errorf("%s %s %s: %d %q, want %d and %q", r.method, r.path, r.body,
+				rw.Code, e.Error, r.status, r.msg)
+		}
+	}
+
+	// Members that a JSON Patch operation does not define are ignored
+	rw := serve(h, http.MethodPatch, "/v3/users/1", `[{"op":"replace","path":"/admin","value":1,"note":"x"}]`,
+		"Authorization", adminAuth, "Content-Type", JSONPatchType)
+	expectStatus(t, rw, http.StatusOK)
+}
@@ -0,0 +1,128 @@
+// Command shandler runs the REST API server of shandler.
+//
+// The configuration is read from the file given with -config, which can
+// be YAML or TOML, then overridden by SHANDLER_* environment variables
+// and finally by command-line flags.
+//
+// SIGINT and SIGTERM shut the server down gracefully. SIGHUP reloads the
+// configuration; only session_ttl, require_if_match, batch_limit,
+// min_free_disk_mb, log_level, the access_log settings, the cors settings,
+// rate_limits, the handler timeouts, the body limits, the password_reset
+// settings, the email_verification settings, attributes_schema and the
+// notifier settings take effect without a restart.
+//
+// Usage:
+//
+//	shandler [-config file] [-listen addr] [-db file] [-images dir] [-print-config]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mactsouk/shandler"
+)
+
+// flags holds the command-line flags that override the configuration
+type flags struct {
+	config string
+	listen string
+	db     string
+	images string
+}
+
+// loadConfig reads the configuration file, the environment and the flags.
+// It is called at startup and again on SIGHUP.
+func loadConfig(f flags) (shandler.Config, error) {
+	config := shandler.DefaultConfig()
+	var err error
+	if f.config != "" {
+		config, err = shandler.LoadConfig(f.config)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err = config.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		return config, err
+	}
+
+	if f.listen != "" {
+		config.Listen = f.listen
+	}
+	if f.db != "" {
+		config.Database = f.db
+	}
+	if f.images != "" {
+		config.Images = f.images
+	}
+	return config, nil
+}
+
+func main() {
+	var f flags
+	flag.StringVar(&f.config, "config", "", "YAML or TOML configuration file")
+	flag.StringVar(&f.listen, "listen", "", "TCP address of the server, overrides listen")
+	flag.StringVar(&f.db, "db", "", "path of the SQLite3 database, overrides database")
+	flag.StringVar(&f.images, "images", "", "directory of uploaded files, overrides images")
+	printConfig := flag.Bool("print-config", false, "print the configuration and exit")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := loadConfig(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shandler:", err)
+		os.Exit(1)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shandler: invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		fmt.Print(config)
+		return
+	}
+
+	srv := shandler.NewServer(config)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				c, err := loadConfig(f)
+				if err == nil {
+					err = srv.Reload(c)
+				}
+				if err != nil {
+					slog.Error("cannot reload configuration", "err", err)
+				}
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), srv.Config().ShutdownTimeout.Duration)
+			srv.Shutdown(ctx)
+			cancel()
+			return
+		}
+	}()
+
+	err = srv.Start()
+	if err != nil {
+		slog.Error("server failed", "err", err)
+		os.Exit(1)
+	}
+}
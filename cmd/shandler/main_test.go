@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shandler.yaml")
+	err := os.WriteFile(path, []byte("listen: :1000\ndatabase: /file/users.db\nimages: /file/images\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SHANDLER_LISTEN", ":2000")
+	t.Setenv("SHANDLER_DATABASE", "/env/users.db")
+
+	// The file is overridden by the environment, which is overridden by the flags
+	c, err := loadConfig(flags{config: path, listen: ":3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":3000" || c.Database != "/env/users.db" || c.Images != "/file/images" {
+		t.Fatalf("listen = %q, database = %q, images = %q", c.Listen, c.Database, c.Images)
+	}
+}
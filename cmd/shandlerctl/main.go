@@ -0,0 +1,432 @@
+// Command shandlerctl is the administration tool of the user database
+// of shandler. It works on the same SQLite3 database as the server.
+//
+// Usage:
+//
+//	shandlerctl [-config file] [-db file] [-images dir] [-v] command [arguments]
+//
+// Run shandlerctl -h for the list of commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mactsouk/shandler"
+)
+
+const usage = `Usage: shandlerctl [-config file] [-db file] [-images dir] [-v] command [arguments]
+
+Commands:
+  init [-force]                             create the database and the admin user
+  migrate                                   apply the missing schema migrations
+  user add [-admin] [-password p] username  create a user
+  user list                                 list all users
+  user show user                            show a user
+  user delete user                          delete a user and its sessions
+  user set-admin user true|false            grant or revoke administrator rights
+  user reset-password [-password p] user    set a new password and revoke sessions
+  sessions list                             list the sessions that have not expired
+  sessions revoke id                        revoke a session
+  sessions revoke -user user                revoke all sessions of a user
+  sessions revoke -expired                  delete the expired sessions
+  files gc [-age d] [-n]                    delete files of interrupted uploads
+  backup file                               write a copy of the database to file
+  restore file                              replace the database with a backup
+
+A user is given either by ID or by username.
+Generated passwords are printed on standard output.
+
+Flags:
+`
+
+// errUsage is returned when a command is called with the wrong arguments
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	configFile := flag.String("config", "", "configuration file of the server")
+	db := flag.String("db", "", "path of the SQLite3 database, overrides the configuration")
+	images := flag.String("images", "", "directory of uploaded files, overrides the configuration")
+	verbose := flag.Bool("v", false, "print the log messages of shandler")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *verbose {
+		shandler.SetupLogging(os.Stderr, shandler.LogText, slog.LevelDebug)
+	} else {
+		shandler.SetupLogging(io.Discard, shandler.LogText, slog.LevelError)
+	}
+
+	// Use the same configuration as the server, so that
+	// both work on the same database
+	config := shandler.DefaultConfig()
+	var err error
+	if *configFile != "" {
+		config, err = shandler.LoadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shandlerctl:", err)
+			os.Exit(1)
+		}
+	}
+	err = config.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shandlerctl:", err)
+		os.Exit(1)
+	}
+	if *db != "" {
+		config.Database = *db
+	}
+	if *images != "" {
+		config.Images = *images
+	}
+	config.Apply()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err = run(flag.Arg(0), flag.Args()[1:])
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shandlerctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run executes a command
+func run(command string, args []string) error {
+	switch command {
+	case "init":
+		return initCommand(args)
+	case "backup":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := requireDatabase(); err != nil {
+			return err
+		}
+		return shandler.BackupDatabase(args[0])
+	case "restore":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return shandler.RestoreDatabase(args[0])
+	case "files":
+		if len(args) == 0 || args[0] != "gc" {
+			return errUsage
+		}
+		return filesGC(args[1:])
+	}
+
+	if err := requireDatabase(); err != nil {
+		return err
+	}
+
+	switch command {
+	case "migrate":
+		if len(args) != 0 {
+			return errUsage
+		}
+		if !shandler.Migrate() {
+			return errors.New("migration failed, run with -v for details")
+		}
+		fmt.Println("Schema version:", shandler.LatestSchemaVersion())
+		return nil
+	case "user":
+		if len(args) == 0 {
+			return errUsage
+		}
+		return userCommand(args[0], args[1:])
+	case "sessions":
+		if len(args) == 0 {
+			return errUsage
+		}
+		return sessionsCommand(args[0], args[1:])
+	}
+	return errUsage
+}
+
+// requireDatabase makes sure that the database exists and is up to date
+func requireDatabase() error {
+	_, err := os.Stat(shandler.SQLFILE)
+	if os.IsNotExist(err) {
+		return errors.New(shandler.SQLFILE + " does not exist, run shandlerctl init")
+	} else if err != nil {
+		return err
+	}
+
+	version, err := shandler.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < shandler.LatestSchemaVersion() {
+		fmt.Fprintln(os.Stderr, "shandlerctl: schema version", version, "is old, run shandlerctl migrate")
+	}
+	return nil
+}
+
+func initCommand(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	force := fs.Bool("force", false, "delete all existing users")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	_, err := os.Stat(shandler.SQLFILE)
+	if err == nil && !*force {
+		return errors.New(shandler.SQLFILE + " exists, use -force to delete all users")
+	}
+
+	password, ok := shandler.CreateDatabase()
+	if !ok {
+		return errors.New("cannot create " + shandler.SQLFILE + ", run with -v for details")
+	}
+	fmt.Println("Created", shandler.SQLFILE, "with user admin and password", password)
+	return nil
+}
+
+// findUser returns the user given by ID or by username
+func findUser(arg string) (shandler.User, error) {
+	var u shandler.User
+	if id, err := strconv.Atoi(arg); err == nil {
+		u = shandler.FindUserID(id)
+	} else {
+		u = shandler.FindUserUsername(arg)
+	}
+
+	if u.Username == "" {
+		return u, errors.New("user " + arg + " not found")
+	}
+	return u, nil
+}
+
+// printUsers prints users as a table
+func printUsers(users []shandler.User) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tADMIN\tACTIVE\tLAST LOGIN\tVERSION")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%t\t%t\t%s\t%d\n", u.ID, u.Username, u.Admin == 1, u.Active == 1,
+			time.Unix(u.LastLogin, 0).Format(time.RFC3339), u.Version)
+	}
+	w.Flush()
+}
+
+func userCommand(command string, args []string) error {
+	fs := flag.NewFlagSet("user "+command, flag.ContinueOnError)
+	admin := fs.Bool("admin", false, "create an administrator")
+	password := fs.String("password", "", "the password, a random one when empty")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	args = fs.Args()
+
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		users := shandler.ReturnAllUsers()
+		if users == nil {
+			return errors.New("cannot read users, run with -v for details")
+		}
+		printUsers(users)
+		return nil
+	case "add":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if shandler.FindUserUsername(args[0]).Username != "" {
+			return errors.New("user " + args[0] + " already exists")
+		}
+
+		generated := *password == ""
+		if generated {
+			p, err := shandler.NewPassword()
+			if err != nil {
+				return err
+			}
+			*password = p
+		}
+
+		in := shandler.UserCreate{Username: args[0], Password: *password}
+		if *admin {
+			in.Admin = 1
+		}
+		if err := in.Validate(); err != nil {
+			return err
+		}
+		if !shandler.AddUser(in.NewUser()) {
+			return errors.New("cannot add user, run with -v for details")
+		}
+		printUsers([]shandler.User{shandler.FindUserUsername(args[0])})
+		if generated {
+			fmt.Println(*password)
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return errUsage
+	}
+	u, err := findUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "show":
+		if len(args) != 1 {
+			return errUsage
+		}
+		printUsers([]shandler.User{u})
+	case "delete":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if !shandler.DeleteUser(u.ID) {
+			return errors.New("cannot delete user, run with -v for details")
+		}
+		fmt.Println("Deleted user", u.ID)
+	case "set-admin":
+		if len(args) != 2 {
+			return errUsage
+		}
+		value, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return errUsage
+		}
+		u.Admin = 0
+		if value {
+			u.Admin = 1
+		}
+		if !shandler.UpdateUserFields(u, []string{"admin"}) {
+			return errors.New("cannot update user, run with -v for details")
+		}
+		printUsers([]shandler.User{shandler.FindUserID(u.ID)})
+	case "reset-password":
+		if len(args) != 1 {
+			return errUsage
+		}
+		generated := *password == ""
+		if generated {
+			p, err := shandler.NewPassword()
+			if err != nil {
+				return err
+			}
+			*password = p
+		}
+		if err := shandler.ValidatePassword(u, *password); err != nil {
+			return err
+		}
+		u.Password = *password
+		if !shandler.UpdateUserFields(u, []string{"password"}) {
+			return errors.New("cannot update user, run with -v for details")
+		}
+		if !shandler.DeleteUserSessions(u.ID) {
+			return errors.New("cannot revoke sessions, run with -v for details")
+		}
+		if err := shandler.DeletePasswordResets(u.ID); err != nil {
+			return err
+		}
+		if generated {
+			fmt.Println(*password)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func sessionsCommand(command string, args []string) error {
+	fs := flag.NewFlagSet("sessions "+command, flag.ContinueOnError)
+	user := fs.String("user", "", "revoke all sessions of a user")
+	expired := fs.Bool("expired", false, "delete the expired sessions")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	args = fs.Args()
+
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		sessions := shandler.ReturnAllSessions()
+		if sessions == nil {
+			return errors.New("cannot read sessions, run with -v for details")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER ID\tUSER\tCREATED\tEXPIRES")
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", s.ID, s.UserID, shandler.FindUserID(s.UserID).Username,
+				time.Unix(s.Created, 0).Format(time.RFC3339), time.Unix(s.Expires, 0).Format(time.RFC3339))
+		}
+		w.Flush()
+		return nil
+	case "revoke":
+		switch {
+		case *expired && *user == "" && len(args) == 0:
+			if !shandler.DeleteExpiredSessions() {
+				return errors.New("cannot delete sessions, run with -v for details")
+			}
+		case *user != "" && !*expired && len(args) == 0:
+			u, err := findUser(*user)
+			if err != nil {
+				return err
+			}
+			if !shandler.DeleteUserSessions(u.ID) {
+				return errors.New("cannot delete sessions, run with -v for details")
+			}
+		case *user == "" && !*expired && len(args) == 1:
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errUsage
+			}
+			if !shandler.DeleteSessionID(id) {
+				return errors.New("session " + args[0] + " not found")
+			}
+		default:
+			return errUsage
+		}
+		return nil
+	}
+	return errUsage
+}
+
+func filesGC(args []string) error {
+	fs := flag.NewFlagSet("files gc", flag.ContinueOnError)
+	age := fs.Duration("age", time.Hour, "minimum age of the files to delete")
+	dryRun := fs.Bool("n", false, "only print the files that would be deleted")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if *dryRun {
+		stale, err := shandler.StaleUploads(shandler.IMAGESPATH, *age)
+		for _, path := range stale {
+			fmt.Println("Would delete", path)
+		}
+		return err
+	}
+
+	deleted, err := shandler.CleanupUploads(shandler.IMAGESPATH, *age)
+	for _, path := range deleted {
+		fmt.Println("Deleted", path)
+	}
+	return err
+}
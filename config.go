@@ -0,0 +1,485 @@
+package shandler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration that is written as a string such as "90s"
+// in configuration files
+type Duration struct {
+	time.Duration
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Config defines the configuration of the server.
+// Every field can be set in a YAML or TOML file and overridden by the
+// environment variable that is shown in its env tag.
+type Config struct {
+	// Listen is the TCP address of the HTTP server
+	Listen string `yaml:"listen" toml:"listen" env:"SHANDLER_LISTEN"`
+	// Database is the path of the SQLite3 database
+	Database string `yaml:"database" toml:"database" env:"SHANDLER_DATABASE"`
+	// Images is the directory of uploaded files
+	Images string `yaml:"images" toml:"images" env:"SHANDLER_IMAGES"`
+	// SessionTTL is how long a session token remains valid
+	SessionTTL Duration `yaml:"session_ttl" toml:"session_ttl" env:"SHANDLER_SESSION_TTL"`
+	// RequireIfMatch makes If-Match mandatory for updates and deletions
+	RequireIfMatch bool `yaml:"require_if_match" toml:"require_if_match" env:"SHANDLER_REQUIRE_IF_MATCH"`
+	// BatchLimit is the maximum number of operations of a batch request
+	BatchLimit int `yaml:"batch_limit" toml:"batch_limit" env:"SHANDLER_BATCH_LIMIT"`
+	// ReadTimeout is the maximum duration for reading a request
+	ReadTimeout Duration `yaml:"read_timeout" toml:"read_timeout" env:"SHANDLER_READ_TIMEOUT"`
+	// WriteTimeout is the maximum duration for writing a response
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout" env:"SHANDLER_WRITE_TIMEOUT"`
+	// IdleTimeout is how long idle keep-alive connections remain open
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SHANDLER_IDLE_TIMEOUT"`
+	// HandlerTimeout is how long a handler can take before the request
+	// fails with 503, zero disables it
+	HandlerTimeout Duration `yaml:"handler_timeout" toml:"handler_timeout" env:"SHANDLER_HANDLER_TIMEOUT"`
+	// HandlerTimeouts override HandlerTimeout for some routes, the first
+	// one that matches a request applies. They can only be set in the file.
+	HandlerTimeouts []RouteTimeout `yaml:"handler_timeouts" toml:"handler_timeouts"`
+	// MaxBodyBytes is the maximum size of request bodies, zero removes it
+	MaxBodyBytes int `yaml:"max_body_bytes" toml:"max_body_bytes" env:"SHANDLER_MAX_BODY_BYTES"`
+	// BodyLimits override MaxBodyBytes for some routes, the first one that
+	// matches a request applies. They can only be set in the file.
+	BodyLimits []BodyLimit `yaml:"body_limits" toml:"body_limits"`
+	// ShutdownTimeout is how long a shutdown waits for requests in progress
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHANDLER_SHUTDOWN_TIMEOUT"`
+	// MinFreeDisk is the free disk space in megabytes below which /readyz fails
+	MinFreeDisk int `yaml:"min_free_disk_mb" toml:"min_free_disk_mb" env:"SHANDLER_MIN_FREE_DISK_MB"`
+	// TraceExporter is where spans are sent: none, stdout or otlp
+	TraceExporter string `yaml:"trace_exporter" toml:"trace_exporter" env:"SHANDLER_TRACE_EXPORTER"`
+	// TraceEndpoint is the host:port of the OTLP/HTTP collector
+	TraceEndpoint string `yaml:"trace_endpoint" toml:"trace_endpoint" env:"SHANDLER_TRACE_ENDPOINT"`
+	// TraceSampleRatio is the fraction of new traces that are recorded
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio" toml:"trace_sample_ratio" env:"SHANDLER_TRACE_SAMPLE_RATIO"`
+	// LogFormat is the format of log records: text or json
+	LogFormat string `yaml:"log_format" toml:"log_format" env:"SHANDLER_LOG_FORMAT"`
+	// LogLevel is the minimum level of log records: debug, info, warn or error
+	LogLevel string `yaml:"log_level" toml:"log_level" env:"SHANDLER_LOG_LEVEL"`
+	// AccessLogFormat is the format of the access log on the standard
+	// output: none, combined, json or template
+	AccessLogFormat string `yaml:"access_log_format" toml:"access_log_format" env:"SHANDLER_ACCESS_LOG_FORMAT"`
+	// AccessLogTemplate is the text/template of the template format
+	AccessLogTemplate string `yaml:"access_log_template" toml:"access_log_template" env:"SHANDLER_ACCESS_LOG_TEMPLATE"`
+	// AccessLogSampleRatio is the fraction of successful requests that are logged
+	AccessLogSampleRatio float64 `yaml:"access_log_sample_ratio" toml:"access_log_sample_ratio" env:"SHANDLER_ACCESS_LOG_SAMPLE_RATIO"`
+	// AccessLogExclude are the paths that are not logged, a trailing * matches a prefix
+	AccessLogExclude []string `yaml:"access_log_exclude" toml:"access_log_exclude" env:"SHANDLER_ACCESS_LOG_EXCLUDE"`
+	// CORSAllowedOrigins are the origins of the browser clients, such as
+	// https://admin.example.com, https://*.example.com for its subdomains
+	// or * for every origin. Cross-origin requests are disabled when empty.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins" toml:"cors_allowed_origins" env:"SHANDLER_CORS_ALLOWED_ORIGINS"`
+	// CORSAllowedMethods are the methods that cross-origin requests can use
+	CORSAllowedMethods []string `yaml:"cors_allowed_methods" toml:"cors_allowed_methods" env:"SHANDLER_CORS_ALLOWED_METHODS"`
+	// CORSAllowedHeaders are the request headers that cross-origin requests can set
+	CORSAllowedHeaders []string `yaml:"cors_allowed_headers" toml:"cors_allowed_headers" env:"SHANDLER_CORS_ALLOWED_HEADERS"`
+	// CORSExposedHeaders are the response headers that browser clients can read
+	CORSExposedHeaders []string `yaml:"cors_exposed_headers" toml:"cors_exposed_headers" env:"SHANDLER_CORS_EXPOSED_HEADERS"`
+	// CORSAllowCredentials lets cross-origin requests send cookies and
+	// Authorization headers, it cannot be used with the * origin
+	CORSAllowCredentials bool `yaml:"cors_allow_credentials" toml:"cors_allow_credentials" env:"SHANDLER_CORS_ALLOW_CREDENTIALS"`
+	// CORSMaxAge is how long browsers can cache the result of a preflight
+	CORSMaxAge Duration `yaml:"cors_max_age" toml:"cors_max_age" env:"SHANDLER_CORS_MAX_AGE"`
+	// RateLimits are the rate limits of the requests, the first rule that
+	// matches a request applies. They can only be set in the file.
+	RateLimits []RateLimitRule `yaml:"rate_limits" toml:"rate_limits"`
+	// PasswordResetTTL is how long a password reset token remains valid
+	PasswordResetTTL Duration `yaml:"password_reset_ttl" toml:"password_reset_ttl" env:"SHANDLER_PASSWORD_RESET_TTL"`
+	// PasswordResetURL is the link of the password reset messages, where
+	// {token} is replaced by the token, such as
+	// https://app.example.com/reset?token={token}
+	PasswordResetURL string `yaml:"password_reset_url" toml:"password_reset_url" env:"SHANDLER_PASSWORD_RESET_URL"`
+	// PasswordResetRequests is how many password resets an account can
+	// request every PasswordResetPer
+	PasswordResetRequests int `yaml:"password_reset_requests" toml:"password_reset_requests" env:"SHANDLER_PASSWORD_RESET_REQUESTS"`
+	// PasswordResetPer is the period of PasswordResetRequests
+	PasswordResetPer Duration `yaml:"password_reset_per" toml:"password_reset_per" env:"SHANDLER_PASSWORD_RESET_PER"`
+	// EmailVerificationTTL is how long an email verification token remains valid
+	EmailVerificationTTL Duration `yaml:"email_verification_ttl" toml:"email_verification_ttl" env:"SHANDLER_EMAIL_VERIFICATION_TTL"`
+	// EmailVerificationURL is the link of the email verification messages,
+	// where {token} is replaced by the token
+	EmailVerificationURL string `yaml:"email_verification_url" toml:"email_verification_url" env:"SHANDLER_EMAIL_VERIFICATION_URL"`
+	// AttributesSchema is the JSON Schema file of the user attributes,
+	// the built-in schema is used when it is empty
+	AttributesSchema string `yaml:"attributes_schema" toml:"attributes_schema" env:"SHANDLER_ATTRIBUTES_SCHEMA"`
+	// Notifier is how messages reach users: none, log, file or smtp
+	Notifier string `yaml:"notifier" toml:"notifier" env:"SHANDLER_NOTIFIER"`
+	// NotifyFile is the file that the file notifier appends messages to
+	NotifyFile string `yaml:"notify_file" toml:"notify_file" env:"SHANDLER_NOTIFY_FILE"`
+	// SMTPAddr is the host:port of the SMTP server of the smtp notifier
+	SMTPAddr string `yaml:"smtp_addr" toml:"smtp_addr" env:"SHANDLER_SMTP_ADDR"`
+	// SMTPFrom is the sender address of the messages
+	SMTPFrom string `yaml:"smtp_from" toml:"smtp_from" env:"SHANDLER_SMTP_FROM"`
+	// SMTPUsername is the user of the SMTP server, no authentication when empty
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username" env:"SHANDLER_SMTP_USERNAME"`
+	// SMTPPassword is the password of SMTPUsername
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password" env:"SHANDLER_SMTP_PASSWORD"`
+}
+
+// DefaultConfig returns the configuration that is used when nothing is set
+func DefaultConfig() Config {
+	return Config{
+		Listen:       ":1234",
+		Database:     "/tmp/users.db",
+		Images:       "/tmp/files",
+		SessionTTL:   Duration{24 * time.Hour},
+		BatchLimit:   500,
+		ReadTimeout:  Duration{time.Minute},
+		WriteTimeout: Duration{time.Minute},
+		IdleTimeout:  Duration{2 * time.Minute},
+
+		HandlerTimeout: Duration{30 * time.Second},
+		HandlerTimeouts: []RouteTimeout{
+			{Route: "/v3/users/export", Method: http.MethodGet},
+			{Route: "/v3/users/import", Method: http.MethodPost, Timeout: Duration{5 * time.Minute}},
+			{Route: "/v3/users/batch", Method: http.MethodPost, Timeout: Duration{5 * time.Minute}},
+			{Route: "/v2/files/*"},
+		},
+		MaxBodyBytes: 1 << 20,
+		BodyLimits: []BodyLimit{
+			{Route: "/v2/files/*", Method: http.MethodPut, MaxBytes: 100 << 20},
+			{Route: "/v3/users/import", Method: http.MethodPost, MaxBytes: 50 << 20},
+			{Route: "/v3/users/batch", Method: http.MethodPost, MaxBytes: 10 << 20},
+		},
+		ShutdownTimeout: Duration{30 * time.Second},
+		MinFreeDisk:     100,
+
+		TraceExporter:    TraceNone,
+		TraceEndpoint:    "localhost:4318",
+		TraceSampleRatio: 1,
+
+		LogFormat: LogText,
+		LogLevel:  "info",
+
+		AccessLogFormat:      AccessLogCombined,
+		AccessLogTemplate:    `{{.Method}} {{.URI}} {{.Status}} {{.Duration}}`,
+		AccessLogSampleRatio: 1,
+		AccessLogExclude:     []string{"/healthz", "/readyz", "/metrics"},
+
+		CORSAllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete},
+		CORSAllowedHeaders: []string{"Authorization", "Content-Type", "If-Match",
+			"If-None-Match", RequestIDHeader},
+		CORSExposedHeaders: []string{"ETag", "Location", RequestIDHeader, "Retry-After",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+		CORSMaxAge: Duration{10 * time.Minute},
+
+		RateLimits: []RateLimitRule{
+			{Route: "/v1/login", Method: http.MethodPost, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v2/login", Method: http.MethodPost, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v3/sessions", Method: http.MethodPost, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v3/users/{id:[0-9]+}/password", Method: http.MethodPut, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v3/password-resets*", Method: http.MethodPost, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v3/users/{id:[0-9]+}/email-verification", Method: http.MethodPost, By: RateLimitByUser, Requests: 5, Per: Duration{time.Hour}},
+			{Route: "/v3/email-verifications/confirm", Method: http.MethodPost, Requests: 10, Per: Duration{time.Minute}},
+			{Route: "/v1/add", Requests: 30, Per: Duration{time.Minute}},
+			{Route: "/v2/add", Requests: 30, Per: Duration{time.Minute}},
+			{Route: "/v2/files/*", Method: http.MethodPut, Requests: 60, Per: Duration{time.Minute}},
+			{Route: "*", By: RateLimitByUser, Requests: 50, Per: Duration{time.Second}, Burst: 100},
+		},
+
+		PasswordResetTTL:      Duration{time.Hour},
+		PasswordResetRequests: 3,
+		PasswordResetPer:      Duration{time.Hour},
+		EmailVerificationTTL:  Duration{24 * time.Hour},
+		Notifier:              NotifierNone,
+		SMTPAddr:              "localhost:25",
+	}
+}
+
+// LoadConfig reads the configuration file at path on top of DefaultConfig.
+// The format is defined by the extension: .yaml, .yml or .toml.
+// Unknown keys are errors, so that typing mistakes are not ignored.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		err = d.Decode(&c)
+		if err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		// toml decodes arrays of tables into the existing elements, so the
+		// default rules would leak into the ones of the file
+		c.RateLimits = nil
+		c.HandlerTimeouts = nil
+		c.BodyLimits = nil
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), &c)
+		if err == nil && len(md.Undecoded()) != 0 {
+			err = errors.New("unknown key " + md.Undecoded()[0].String())
+		}
+		if !md.IsDefined("rate_limits") {
+			c.RateLimits = DefaultConfig().RateLimits
+		}
+		if !md.IsDefined("handler_timeouts") {
+			c.HandlerTimeouts = DefaultConfig().HandlerTimeouts
+		}
+		if !md.IsDefined("body_limits") {
+			c.BodyLimits = DefaultConfig().BodyLimits
+		}
+	default:
+		err = errors.New("unknown configuration format " + strconv.Quote(filepath.Ext(path)))
+	}
+
+	if err != nil {
+		return c, errors.New(path + ": " + err.Error())
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides the fields of c with the environment variables that
+// are defined by the env tags. lookup is usually os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		value, ok := lookup(name)
+		if name == empty || !ok {
+			continue
+		}
+
+		err := setField(v.Field(i), value)
+		if err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// setField sets a field of Config from the string value of an environment variable
+func setField(f reflect.Value, value string) error {
+	switch p := f.Addr().Interface().(type) {
+	case *string:
+		*p = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid boolean " + strconv.Quote(value))
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid integer " + strconv.Quote(value))
+		}
+		*p = n
+	case *float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("invalid number " + strconv.Quote(value))
+		}
+		*p = x
+	case *[]string:
+		*p = []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != empty {
+				*p = append(*p, s)
+			}
+		}
+	case *Duration:
+		err := p.UnmarshalText([]byte(value))
+		if err != nil {
+			return errors.New("invalid duration " + strconv.Quote(value))
+		}
+	default:
+		return errors.New("unsupported type " + f.Type().String())
+	}
+	return nil
+}
+
+// Validate checks every field of c and returns all the problems it finds
+func (c Config) Validate() error {
+	errs := []error{}
+	invalid := func(field, msg string) {
+		errs = append(errs, errors.New(field+": "+msg))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		invalid("listen", "must be host:port, such as :1234")
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		invalid("listen", "invalid port "+strconv.Quote(port))
+	}
+
+	if c.Database == empty {
+		invalid("database", "is required")
+	} else if info, err := os.Stat(filepath.Dir(c.Database)); err != nil || !info.IsDir() {
+		invalid("database", "directory "+filepath.Dir(c.Database)+" does not exist")
+	}
+
+	if c.Images == empty {
+		invalid("images", "is required")
+	}
+
+	if c.SessionTTL.Duration <= 0 {
+		invalid("session_ttl", "must be positive")
+	}
+	if c.BatchLimit <= 0 {
+		invalid("batch_limit", "must be positive")
+	}
+	if c.ReadTimeout.Duration < 0 {
+		invalid("read_timeout", "cannot be negative")
+	}
+	if c.WriteTimeout.Duration < 0 {
+		invalid("write_timeout", "cannot be negative")
+	}
+	if c.IdleTimeout.Duration < 0 {
+		invalid("idle_timeout", "cannot be negative")
+	}
+	if c.HandlerTimeout.Duration < 0 {
+		invalid("handler_timeout", "cannot be negative")
+	}
+	for i, t := range c.HandlerTimeouts {
+		if err := t.validate(); err != nil {
+			invalid("handler_timeouts["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+	if c.MaxBodyBytes < 0 {
+		invalid("max_body_bytes", "cannot be negative")
+	}
+	for i, b := range c.BodyLimits {
+		if err := b.validate(); err != nil {
+			invalid("body_limits["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		invalid("shutdown_timeout", "must be positive")
+	}
+	if c.MinFreeDisk < 0 {
+		invalid("min_free_disk_mb", "cannot be negative")
+	}
+
+	switch c.TraceExporter {
+	case TraceNone, TraceStdout:
+	case TraceOTLP:
+		if _, _, err := net.SplitHostPort(c.TraceEndpoint); err != nil {
+			invalid("trace_endpoint", "must be host:port, such as localhost:4318")
+		}
+	default:
+		invalid("trace_exporter", "must be none, stdout or otlp")
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		invalid("trace_sample_ratio", "must be between 0 and 1")
+	}
+
+	if c.LogFormat != LogText && c.LogFormat != LogJSON {
+		invalid("log_format", "must be text or json")
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level", "must be debug, info, warn or error")
+	}
+
+	if _, err := NewAccessLogger(io.Discard, c); err != nil {
+		invalid("access_log_format", err.Error())
+	}
+	if c.AccessLogSampleRatio < 0 || c.AccessLogSampleRatio > 1 {
+		invalid("access_log_sample_ratio", "must be between 0 and 1")
+	}
+
+	if _, err := NewCORS(c); err != nil {
+		invalid("cors_allowed_origins", err.Error())
+	}
+	if len(c.CORSAllowedOrigins) != 0 && len(c.CORSAllowedMethods) == 0 {
+		invalid("cors_allowed_methods", "is required with cors_allowed_origins")
+	}
+	if c.CORSMaxAge.Duration < 0 {
+		invalid("cors_max_age", "cannot be negative")
+	}
+
+	for i, rule := range c.RateLimits {
+		if err := rule.validate(); err != nil {
+			invalid("rate_limits["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+
+	if c.PasswordResetTTL.Duration <= 0 {
+		invalid("password_reset_ttl", "must be positive")
+	}
+	if c.PasswordResetURL != empty && !strings.Contains(c.PasswordResetURL, "{token}") {
+		invalid("password_reset_url", "must contain {token}")
+	}
+	if c.PasswordResetRequests <= 0 {
+		invalid("password_reset_requests", "must be positive")
+	}
+	if c.PasswordResetPer.Duration <= 0 {
+		invalid("password_reset_per", "must be positive")
+	}
+	if c.EmailVerificationTTL.Duration <= 0 {
+		invalid("email_verification_ttl", "must be positive")
+	}
+	if c.EmailVerificationURL != empty && !strings.Contains(c.EmailVerificationURL, "{token}") {
+		invalid("email_verification_url", "must contain {token}")
+	}
+	if _, err := LoadAttributesSchema(c.AttributesSchema); err != nil {
+		invalid("attributes_schema", err.Error())
+	}
+	if _, err := NewNotifier(c); err != nil {
+		invalid("notifier", err.Error())
+	}
+	return errors.Join(errs...)
+}
+
+// Apply copies c to the package variables that the handlers use
+func (c Config) Apply() {
+	SQLFILE = c.Database
+	IMAGESPATH = c.Images
+	SESSIONTTL = c.SessionTTL.Duration
+	REQUIREIFMATCH = c.RequireIfMatch
+	BATCHLIMIT = c.BatchLimit
+	MINFREEDISK = c.MinFreeDisk
+	RESETTTL = c.PasswordResetTTL.Duration
+	RESETURL = c.PasswordResetURL
+	RESETREQUESTS = c.PasswordResetRequests
+	RESETPER = c.PasswordResetPer.Duration
+	VERIFYTTL = c.EmailVerificationTTL.Duration
+	VERIFYURL = c.EmailVerificationURL
+}
+
+// String returns c in YAML, without the SMTP password
+func (c Config) String() string {
+	if c.SMTPPassword != empty {
+		c.SMTPPassword = redacted
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
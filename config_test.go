@@ -0,0 +1,132 @@
+package shandler
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a configuration file named name and returns its path
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	files := map[string]string{
+		"shandler.yaml": "session_ttl: 2h\nlog_level: debug\n",
+		"shandler.toml": "session_ttl = \"2h\"\nlog_level = \"debug\"\n",
+	}
+	for name, data := range files {
+		c, err := LoadConfig(writeConfig(t, name, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file is read on top of the defaults
+		if c.SessionTTL.Duration != 2*time.Hour || c.LogLevel != "debug" || c.BatchLimit != DefaultConfig().BatchLimit {
+			t.Fatalf("%s: config = %+v", name, c)
+		}
+		if len(c.RateLimits) != len(DefaultConfig().RateLimits) {
+			t.Fatalf("%s: rate_limits = %+v", name, c.RateLimits)
+		}
+	}
+
+	_, err := LoadConfig(writeConfig(t, "shandler.yaml", "sesion_ttl: 2h\n"))
+	if err == nil || !strings.Contains(err.Error(), "sesion_ttl") {
+		t.Fatalf("err = %v, want an unknown key error", err)
+	}
+	_, err = LoadConfig(writeConfig(t, "shandler.json", "{}"))
+	if err == nil {
+		t.Fatal("an unknown format was accepted")
+	}
+}
+
+func TestApplyEnvOverridesFile(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "shandler.yaml", "session_ttl: 2h\nlog_level: debug\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"SHANDLER_LOG_LEVEL":            "warn",
+		"SHANDLER_CORS_ALLOWED_ORIGINS": "https://a.example.com, https://b.example.com",
+	}
+	err = c.ApplyEnv(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "warn" || c.SessionTTL.Duration != 2*time.Hour {
+		t.Fatalf("config = %+v", c)
+	}
+	if len(c.CORSAllowedOrigins) != 2 || c.CORSAllowedOrigins[1] != "https://b.example.com" {
+		t.Fatalf("cors_allowed_origins = %q", c.CORSAllowedOrigins)
+	}
+
+	env = map[string]string{"SHANDLER_SESSION_TTL": "forever"}
+	err = c.ApplyEnv(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err == nil || !strings.Contains(err.Error(), "SHANDLER_SESSION_TTL") {
+		t.Fatalf("err = %v, want an error about SHANDLER_SESSION_TTL", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	c := testConfig(t)
+	c.AccessLogFormat = AccessLogNone
+	s := NewServer(c)
+	t.Cleanup(func() {
+		s.Reload(c)
+		SetAccessLogger(nil)
+	})
+
+	changed := c
+	changed.SessionTTL = Duration{2 * time.Hour}
+	changed.BatchLimit = 10
+	changed.LogLevel = "debug"
+	err := s.Reload(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SESSIONTTL != 2*time.Hour || BATCHLIMIT != 10 || LOGLEVEL.Level() != slog.LevelDebug {
+		t.Fatalf("the settings were not applied")
+	}
+	if s.Config().SessionTTL.Duration != 2*time.Hour {
+		t.Fatalf("config = %+v", s.Config())
+	}
+
+	// An invalid configuration changes nothing
+	invalid := changed
+	invalid.SessionTTL = Duration{time.Hour}
+	invalid.LogLevel = "loud"
+	err = s.Reload(invalid)
+	if err == nil || !strings.Contains(err.Error(), "log_level") {
+		t.Fatalf("err = %v, want an error about log_level", err)
+	}
+	if SESSIONTTL != 2*time.Hour || s.Config().LogLevel != "debug" {
+		t.Fatal("an invalid configuration was applied")
+	}
+
+	// Settings that need a restart are kept
+	restart := changed
+	restart.Listen = "127.0.0.1:1"
+	err = s.Reload(restart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config().Listen != c.Listen {
+		t.Fatalf("listen = %q", s.Config().Listen)
+	}
+}
@@ -0,0 +1,154 @@
+package shandler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// CORS answers the cross-origin requests of browser clients
+type CORS struct {
+	origins     []string
+	methods     string
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// validOrigin returns true when pattern is *, an origin such as
+// https://admin.example.com or an origin with a wildcard subdomain
+// such as https://*.example.com
+func validOrigin(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	u, err := url.Parse(strings.Replace(pattern, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return u.Host != empty && u.Path == empty && u.RawQuery == empty && u.User == nil
+}
+
+// NewCORS returns a CORS with the cors_* settings of c.
+// It returns nil when no origin is allowed.
+func NewCORS(c Config) (*CORS, error) {
+	if len(c.CORSAllowedOrigins) == 0 {
+		return nil, nil
+	}
+
+	for _, o := range c.CORSAllowedOrigins {
+		if !validOrigin(o) {
+			return nil, errors.New("invalid origin " + strconv.Quote(o))
+		}
+		if o == "*" && c.CORSAllowCredentials {
+			return nil, errors.New("the * origin cannot be used with credentials")
+		}
+	}
+
+	methods := make([]string, len(c.CORSAllowedMethods))
+	for i, m := range c.CORSAllowedMethods {
+		methods[i] = strings.ToUpper(m)
+	}
+
+	return &CORS{
+		origins:     c.CORSAllowedOrigins,
+		methods:     strings.Join(methods, ", "),
+		headers:     strings.Join(c.CORSAllowedHeaders, ", "),
+		exposed:     strings.Join(c.CORSExposedHeaders, ", "),
+		credentials: c.CORSAllowCredentials,
+		maxAge:      strconv.Itoa(int(c.CORSMaxAge.Seconds())),
+	}, nil
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for origin,
+// which is empty when origin is not allowed
+func (c *CORS) allowOrigin(origin string) string {
+	for _, o := range c.origins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+
+		// https://*.example.com matches https://a.example.com and
+		// https://a.b.example.com but not https://example.com
+		scheme, domain, ok := strings.Cut(o, "://*.")
+		if !ok {
+			continue
+		}
+		host, ok := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+		if ok && strings.HasSuffix(host, "."+strings.ToLower(domain)) &&
+			!strings.ContainsAny(host, "/?#@") {
+			return origin
+		}
+	}
+	return empty
+}
+
+// corsPolicy is the CORS of CORSMiddleWare, nil when disabled
+var corsPolicy atomic.Pointer[CORS]
+
+// SetCORS replaces the CORS of CORSMiddleWare.
+// A nil CORS disables cross-origin requests.
+func SetCORS(c *CORS) {
+	corsPolicy.Store(c)
+}
+
+// CORSMiddleWare sets the CORS headers of the requests of allowed origins
+// and answers their preflight requests with 204 No Content. Preflights are
+// OPTIONS requests, which no route accepts, so the middleware also wraps
+// the fallback handlers of NewRouter.
+func CORSMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c := corsPolicy.Load()
+		origin := r.Header.Get("Origin")
+		if c == nil || origin == empty {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != empty
+		h := rw.Header()
+		h.Add("Vary", "Origin")
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowed := c.allowOrigin(origin)
+		if allowed == empty {
+			if preflight {
+				logger(r.Context()).Warn("origin not allowed", "origin", origin)
+				writeError(rw, http.StatusForbidden, "origin not allowed")
+				return
+			}
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if c.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if c.exposed != empty {
+				h.Set("Access-Control-Expose-Headers", c.exposed)
+			}
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", c.methods)
+		if c.headers != empty {
+			h.Set("Access-Control-Allow-Headers", c.headers)
+		}
+		h.Set("Access-Control-Max-Age", c.maxAge)
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
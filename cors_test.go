@@ -0,0 +1,92 @@
+package shandler
+
+import (
+	"net/http"
+	"testing"
+)
+
+// allowOrigins sets the CORS policy of c with origins until t ends
+func allowOrigins(t *testing.T, credentials bool, origins ...string) {
+	t.Helper()
+	c := DefaultConfig()
+	c.CORSAllowedOrigins = origins
+	c.CORSAllowCredentials = credentials
+	cors, err := NewCORS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := corsPolicy.Load()
+	SetCORS(cors)
+	t.Cleanup(func() { SetCORS(old) })
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newTestServer(t)
+	allowOrigins(t, true, "https://admin.example.com", "https://*.example.org")
+
+	for _, origin := range []string{"https://admin.example.com", "https://a.b.example.org"} {
+		rw := serve(h, http.MethodOptions, "/v3/users/1", empty, "Origin", origin,
+			"Access-Control-Request-Method", http.MethodPatch)
+		expectStatus(t, rw, http.StatusNoContent)
+		header := rw.Header()
+		if header.Get("Access-Control-Allow-Origin") != origin || header.Get("Access-Control-Allow-Credentials") != "true" ||
+			header.Get("Access-Control-Allow-Methods") != "GET, POST, PUT, PATCH, DELETE" ||
+			header.Get("Access-Control-Max-Age") != "600" || header.Get("Access-Control-Allow-Headers") == empty {
+			t.Fatalf("%s: headers = %v", origin, header)
+		}
+	}
+
+	// Other origins, including the parent domain of a wildcard, are refused
+	for _, origin := range []string{"https://evil.example.com", "https://example.org", "http://a.example.org"} {
+		rw := serve(h, http.MethodOptions, "/v3/users/1", empty, "Origin", origin,
+			"Access-Control-Request-Method", http.MethodPatch)
+		expectStatus(t, rw, http.StatusForbidden)
+		if rw.Header().Get("Access-Control-Allow-Origin") != empty {
+			t.Fatalf("%s: headers = %v", origin, rw.Header())
+		}
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	h := newTestServer(t)
+	allowOrigins(t, false, "*")
+
+	rw := serve(h, http.MethodGet, "/v1/username/1", empty, "Origin", "https://any.example.com")
+	expectStatus(t, rw, http.StatusOK)
+	header := rw.Header()
+	if header.Get("Access-Control-Allow-Origin") != "*" || header.Get("Access-Control-Expose-Headers") == empty ||
+		header.Get("Access-Control-Allow-Credentials") != empty || header.Get("Vary") != "Origin" {
+		t.Fatalf("headers = %v", header)
+	}
+
+	// Requests without an Origin are not changed
+	rw = serve(h, http.MethodGet, "/v1/username/1", empty)
+	if rw.Header().Get("Access-Control-Allow-Origin") != empty {
+		t.Fatalf("headers = %v", rw.Header())
+	}
+
+	// Without allowed origins, cross-origin requests get no CORS headers
+	SetCORS(nil)
+	rw = serve(h, http.MethodGet, "/v1/username/1", empty, "Origin", "https://any.example.com")
+	expectStatus(t, rw, http.StatusOK)
+	if rw.Header().Get("Access-Control-Allow-Origin") != empty {
+		t.Fatalf("headers = %v", rw.Header())
+	}
+}
+
+func TestNewCORS(t *testing.T) {
+	for _, origins := range [][]string{{"admin.example.com"}, {"https://example.com/path"}, {"ftp://example.com"}} {
+		c := DefaultConfig()
+		c.CORSAllowedOrigins = origins
+		if _, err := NewCORS(c); err == nil {
+			t.Fatalf("%q was accepted", origins)
+		}
+	}
+
+	c := DefaultConfig()
+	c.CORSAllowedOrigins = []string{"*"}
+	c.CORSAllowCredentials = true
+	if _, err := NewCORS(c); err == nil {
+		t.Fatal("* was accepted with credentials")
+	}
+}
@@ -2,13 +2,16 @@ package shandler
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/go-playground/validator"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -28,11 +31,71 @@ type User struct {
 	// in: body
 	//
 	// required: true
-	Username string `json:"user"`
+	// pattern: ^[a-zA-Z0-9][a-zA-Z0-9._-]{2,31}$
+	Username string `json:"user" validate:"required,username"`
 	// The Password of the User
 	//
 	// required: true
-	Password string `json:"password"`
+	// min length: 8
+	// max length: 72
+	Password string `json:"password" validate:"required,min=8,maxbytes=72,nefield=Username"`
+	// The Email address of the User, where password resets are sent
+	//
+	// required: false
+	// max length: 254
+	Email string `json:"email,omitempty" validate:"omitempty,max=254,email"`
+	// Has the User confirmed the Email address or not
+	//
+	// required: false
+	EmailVerified int `json:"email_verified" validate:"oneof=0 1"`
+	// The Last Login time of the User
+	//
+	// required: true
+	// min: 0
+	LastLogin int64 `json:"lastlogin" validate:"gte=0"`
+	// Is the User Admin or not
+	//
+	// required: true
+	Admin int `json:"admin" validate:"oneof=0 1"`
+	// Is the User Logged In or Not
+	//
+	// required: true
+	Active int `json:"active" validate:"oneof=0 1"`
+	// The Version of the User record, incremented on every update,
+	// logins and logouts included
+	//
+	// required: false
+	// min: 1
+	Version int64 `json:"version" validate:"gte=0"`
+	// The profile Attributes of the User, a JSON object that follows
+	// the attributes schema
+	//
+	// required: false
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// UserView defines the public representation of a User record.
+// It does not have a Password field, so a UserView can be
+// returned to any client without leaking credentials.
+// swagger:model UserView
+type UserView struct {
+	// The ID for the User
+	//
+	// required: true
+	// min: 1
+	ID int `json:"id"`
+	// The Username of the User
+	//
+	// required: true
+	Username string `json:"user"`
+	// The Email address of the User
+	//
+	// required: false
+	Email string `json:"email,omitempty"`
+	// Has the User confirmed the Email address or not
+	//
+	// required: true
+	EmailVerified int `json:"email_verified"`
 	// The Last Login time of the User
 	//
 	// required: true
@@ -46,6 +109,16 @@ type User struct {
 	//
 	// required: true
 	Active int `json:"active"`
+	// The Version of the User record, incremented on every update,
+	// logins and logouts included
+	//
+	// required: false
+	// min: 1
+	Version int64 `json:"version"`
+	// The profile Attributes of the User
+	//
+	// required: false
+	Attributes json.RawMessage `json:"attributes,omitempty"`
 }
 
 // Input defines the structure for the user issuing a command
@@ -55,16 +128,19 @@ type Input struct {
 	// in: body
 	//
 	// required: true
-	Username string `json:"user"`
+	// pattern: ^[a-zA-Z0-9][a-zA-Z0-9._-]{2,31}$
+	Username string `json:"user" validate:"required,username"`
 	// The Password of the User
 	// in: body
 	//
 	// required: true
-	Password string `json:"password"`
+	// min length: 8
+	// max length: 72
+	Password string `json:"password" validate:"required,min=8,maxbytes=72,nefield=Username"`
 	// Is the User Admin or not
 	//
 	// required: true
-	Admin int `json:"admin"`
+	Admin int `json:"admin" validate:"oneof=0 1"`
 }
 
 // UserPass defines the structure for the user issuing a command
@@ -122,16 +198,48 @@ func PrettyJSON(data interface{}) (string, error) {
 	return buffer.String(), nil
 }
 
+// View returns the public representation of a User
+func (p User) View() UserView {
+	return UserView{
+		ID:            p.ID,
+		Username:      p.Username,
+		Email:         p.Email,
+		EmailVerified: p.EmailVerified,
+		LastLogin:     p.LastLogin,
+		Admin:         p.Admin,
+		Active:        p.Active,
+		Version:       p.Version,
+		Attributes:    p.Attributes,
+	}
+}
+
+// Views returns the public representation of a slice of User records
+func Views(users []User) []UserView {
+	views := make([]UserView, 0, len(users))
+	for _, u := range users {
+		views = append(views, u.View())
+	}
+	return views
+}
+
+// MarshalJSON serializes a User using its public representation.
+// This guarantees that the Password field is never encoded, even
+// when a User is passed to SliceToJSON or PrettyJSON directly.
+// Decoding is not affected, so clients can still send passwords.
+func (p User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.View())
+}
+
 // FromJSON decodes a serialized JSON record - User{}
 func (p *User) FromJSON(r io.Reader) error {
 	e := json.NewDecoder(r)
 	return e.Decode(p)
 }
 
-// ToJSON serializes a JSON record
+// ToJSON serializes a JSON record without the password of the User
 func (p *User) ToJSON(w io.Writer) error {
 	e := json.NewEncoder(w)
-	return e.Encode(p)
+	return e.Encode(p.View())
 }
 
 // FromJSON decodes a serialized JSON record - UserPass{}
@@ -158,326 +266,739 @@ func SliceToJSON(slice interface{}, w io.Writer) error {
 	return e.Encode(slice)
 }
 
+// ErrUserNotFound is returned when a user record does not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrVersionMismatch is returned when a user record has been
+// modified since the version that the caller expected
+var ErrVersionMismatch = errors.New("user record has been modified")
+
+// userSelect is the column list of every query that returns users
+const userSelect = "SELECT ID, Username, Password, Email, EmailVerified, LastLogin, Admin, Active, Version, Attributes FROM users"
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is implemented by *sql.DB and *sql.Tx, so that the same
+// statements can run on their own or as part of a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanUser reads a User from a row returned by a userSelect query
+func scanUser(row scanner) (User, error) {
+	u := User{}
+	var attributes string
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Email, &u.EmailVerified, &u.LastLogin, &u.Admin, &u.Active, &u.Version, &attributes)
+	u.Attributes = json.RawMessage(attributes)
+	return u, err
+}
+
+// execFindUser returns the first user that matches column = value
+func execFindUser(q execer, column string, value interface{}) (User, error) {
+	u, err := scanUser(q.QueryRow(userSelect+" WHERE "+column+" = ? ORDER BY ID LIMIT 1", value))
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	return u, err
+}
+
+// normalizeEmail returns the form of email that is stored and compared,
+// so that an address belongs to a single user whatever its case
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// execInsertUser adds u to the database and returns its ID.
+// The password of u must already be hashed with HashPassword.
+// The email address is normalized and not verified.
+func execInsertUser(q execer, u User) (int, error) {
+	attributes, err := storedAttributes(u.Attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := q.Exec("INSERT INTO users(Username, Password, Email, LastLogin, Admin, Active, Version, Attributes) values(?,?,?,?,?,?,1,?)",
+		u.Username, u.Password, normalizeEmail(u.Email), u.LastLogin, u.Admin, u.Active, attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
 // AddUser is for adding a new user to the database
 func AddUser(u User) bool {
-	log.Println("Adding user:", u)
-	db, err := sql.Open("sqlite3", SQLFILE)
+	return AddUserContext(context.Background(), u)
+}
+
+// AddUserContext is like AddUser, with ctx for tracing and cancellation
+func AddUserContext(ctx context.Context, u User) bool {
+	ctx, end := startOperation(ctx, "AddUser", "add_user")
+	defer end()
+
+	logger(ctx).Debug("adding user", "username", u.Username)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return false
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare("INSERT INTO users(Username, Password, LastLogin, Admin, Active) values(?,?,?,?,?)")
+	u.Password, err = HashPassword(u.Password)
+	if err != nil {
+		logger(ctx).Error("cannot hash password", "username", u.Username, "err", err)
+		return false
+	}
+	_, err = execInsertUser(db, u)
 	if err != nil {
-		log.Println("Adduser:", err)
+		logger(ctx).Error("cannot add user", "username", u.Username, "err", err)
 		return false
 	}
-	stmt.Exec(u.Username, u.Password, u.LastLogin, u.Admin, u.Active)
 	return true
 }
 
-// UpdateUser allows you to update user name
-func UpdateUser(u User) bool {
-	log.Println("Updating user:", u)
+// userColumns maps the JSON fields of a User to the columns of the users table
+var userColumns = map[string]string{
+	"user":       "Username",
+	"password":   "Password",
+	"email":      "Email",
+	"lastlogin":  "LastLogin",
+	"admin":      "Admin",
+	"active":     "Active",
+	"attributes": "Attributes",
+}
 
-	db, err := sql.Open("sqlite3", SQLFILE)
+// allUserFields lists the fields of a User that UpdateUser replaces.
+// The attributes are only updated on their own, so that the handlers
+// that do not know them keep them.
+var allUserFields = []string{"user", "password", "email", "lastlogin", "admin", "active"}
+
+// execUpdateUser updates the given fields of u and increments its version,
+// so that the ETag of the record changes with every field it serializes.
+// The password of u must already be hashed with HashPassword.
+// When version is not zero, the record is only updated if its stored
+// version is equal to version, otherwise ErrVersionMismatch is returned.
+func execUpdateUser(q execer, u User, fields []string, version int64) error {
+	set := []string{}
+	args := []interface{}{}
+	values := map[string]interface{}{
+		"user":      u.Username,
+		"password":  u.Password,
+		"email":     normalizeEmail(u.Email),
+		"lastlogin": u.LastLogin,
+		"admin":     u.Admin,
+		"active":    u.Active,
+	}
+	for _, f := range fields {
+		column, ok := userColumns[f]
+		if !ok {
+			return errors.New("unknown field " + f)
+		}
+		value := values[f]
+		if f == "attributes" {
+			attributes, err := storedAttributes(u.Attributes)
+			if err != nil {
+				return err
+			}
+			value = attributes
+		}
+		if f == "email" {
+			// A new address has to be verified again. The right side
+			// of SET sees the old Email, so it goes first.
+			set = append(set, "EmailVerified=CASE WHEN Email=? THEN EmailVerified ELSE 0 END")
+			args = append(args, value)
+		}
+		set = append(set, column+"=?")
+		args = append(args, value)
+	}
+	set = append(set, "Version=Version+1")
+
+	query := "UPDATE users SET " + strings.Join(set, ", ") + " WHERE ID = ?"
+	args = append(args, u.ID)
+	if version != 0 {
+		query += " AND Version = ?"
+		args = append(args, version)
+	}
+
+	res, err := q.Exec(query, args...)
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare("UPDATE users SET Username=?, Password=?, LastLogin=?, Admin=?, Active =? WHERE ID = ?\n")
+	affect, err := res.RowsAffected()
 	if err != nil {
-		log.Println("Statement failed:", err)
-		return false
+		return err
+	}
+	if affect == 0 {
+		var count int
+		err = q.QueryRow("SELECT COUNT(*) FROM users WHERE ID = ?", u.ID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+		return ErrVersionMismatch
 	}
+	return nil
+}
+
+// updateUser runs execUpdateUser on its own, after hashing the
+// password of u when it is one of fields
+func updateUser(ctx context.Context, u User, fields []string, version int64) error {
+	ctx, end := startOperation(ctx, "UpdateUser", "update_user")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f == "password" {
+			u.Password, err = HashPassword(u.Password)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = execUpdateUser(db, u, fields, version)
+	traceError(ctx, err)
+	return err
+}
 
-	res, err := stmt.Exec(u.Username, u.Password, u.LastLogin, u.Admin, u.Active, u.ID)
+// UpdateUser allows you to update user name.
+// Every field is replaced and the password of u is hashed, so u must
+// have the new password in plain text. Use UpdateUserFields to keep it.
+func UpdateUser(u User) bool {
+	return UpdateUserContext(context.Background(), u)
+}
+
+// UpdateUserContext is like UpdateUser, with ctx for tracing and cancellation
+func UpdateUserContext(ctx context.Context, u User) bool {
+	logger(ctx).Debug("updating user", "id", u.ID)
+
+	err := updateUser(ctx, u, allUserFields, 0)
 	if err != nil {
-		log.Println("Exec failed:", err)
+		logger(ctx).Error("cannot update user", "id", u.ID, "err", err)
 		return false
 	}
+	return true
+}
 
-	affect, err := res.RowsAffected()
-	log.Println("Affected:", affect)
+// UpdateUserFields updates only the given fields of a user.
+// Fields are named after the JSON keys of User.
+func UpdateUserFields(u User, fields []string) bool {
+	return UpdateUserFieldsContext(context.Background(), u, fields)
+}
+
+// UpdateUserFieldsContext is like UpdateUserFields, with ctx for tracing and cancellation
+func UpdateUserFieldsContext(ctx context.Context, u User, fields []string) bool {
+	logger(ctx).Debug("updating user", "id", u.ID, "fields", fields)
+	if len(fields) == 0 {
+		return true
+	}
+
+	err := updateUser(ctx, u, fields, 0)
+	if err != nil {
+		logger(ctx).Error("cannot update user", "id", u.ID, "err", err)
+		return false
+	}
 	return true
 }
 
+// newAdminPassword returns the password of the admin user of CreateDatabase
+var newAdminPassword = NewPassword
+
 // CreateDatabase initializes the SQLite3 database and adds the admin user
-func CreateDatabase() bool {
-	log.Println("Writing to SQLite3:", SQLFILE)
-	db, err := sql.Open("sqlite3", SQLFILE)
+// with a random password, which it returns. Only the hash of the password
+// is stored, so callers must show it right away.
+func CreateDatabase() (string, bool) {
+	slog.Info("creating database", "database", SQLFILE)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
-		return false
+		slog.Error("cannot open database", "err", err)
+		return empty, false
 	}
-	defer db.Close()
 
-	log.Println("Emptying database table.")
+	slog.Info("dropping tables")
 	_, _ = db.Exec("DROP TABLE users")
+	_, _ = db.Exec("DROP TABLE sessions")
+	_, _ = db.Exec("DROP TABLE password_resets")
+	_, _ = db.Exec("DROP TABLE email_verifications")
+	_, _ = db.Exec("PRAGMA user_version = 0")
+
+	slog.Info("creating tables")
+	if !Migrate() {
+		return empty, false
+	}
 
-	log.Println("Creating table from scratch.")
-	_, err = db.Exec("CREATE TABLE users (ID integer NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Password TEXT, Lastlogin integer, Admin integer, Active integer);")
+	slog.Info("adding admin user", "database", SQLFILE)
+	password, err := newAdminPassword()
 	if err != nil {
-		log.Println(err)
-		return false
+		slog.Error("cannot generate password", "err", err)
+		return empty, false
+	}
+	admin := User{ID: -1, Username: "admin", Password: password, LastLogin: time.Now().Unix(), Admin: 1}
+	if !AddUser(admin) {
+		return empty, false
+	}
+	return password, true
+}
+
+// execDeleteUser deletes the user defined by ID and its sessions.
+// When version is not zero, the record is only deleted if its stored
+// version is equal to version, otherwise ErrVersionMismatch is returned.
+func execDeleteUser(q execer, ID int, version int64) error {
+	query := "DELETE FROM users WHERE ID = ?"
+	args := []interface{}{ID}
+	if version != 0 {
+		query += " AND Version = ?"
+		args = append(args, version)
+	}
+
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return err
 	}
 
-	log.Println("Populating", SQLFILE)
-	admin := User{-1, "admin", "admin", time.Now().Unix(), 1, 0}
-	return AddUser(admin)
+	affect, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affect == 0 && version != 0 {
+		return ErrVersionMismatch
+	}
+
+	_, err = q.Exec("DELETE FROM sessions WHERE UserID = ?", ID)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM password_resets WHERE UserID = ?", ID)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM email_verifications WHERE UserID = ?", ID)
+	return err
 }
 
-// DeleteUser is for deleting a user defined by ID
-func DeleteUser(ID int) bool {
-	log.Println("Deleting from SQLite3:", ID)
-	db, err := sql.Open("sqlite3", SQLFILE)
+// deleteUser runs execDeleteUser on its own
+func deleteUser(ctx context.Context, ID int, version int64) error {
+	ctx, end := startOperation(ctx, "DeleteUser", "delete_user")
+	defer end()
+
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
 	}
-	defer db.Close()
 
-	stmt, _ := db.Prepare("DELETE FROM users WHERE ID = ?")
+	err = execDeleteUser(db, ID, version)
+	traceError(ctx, err)
+	return err
+}
+
+// DeleteUser is for deleting a user defined by ID
+func DeleteUser(ID int) bool {
+	return DeleteUserContext(context.Background(), ID)
+}
+
+// DeleteUserContext is like DeleteUser, with ctx for tracing and cancellation
+func DeleteUserContext(ctx context.Context, ID int) bool {
+	logger(ctx).Debug("deleting user", "id", ID)
+	err := deleteUser(ctx, ID, 0)
 	if err != nil {
-		log.Println("DeleteUser:", err)
+		logger(ctx).Error("cannot delete user", "id", ID, "err", err)
 		return false
 	}
-	stmt.Exec(ID)
 	return true
 }
 
 // ReturnAllUsers is for returning all users from database
 func ReturnAllUsers() []User {
-	log.Println("Reading from SQLite3:", SQLFILE)
-	db, err := sql.Open("sqlite3", SQLFILE)
+	return ReturnAllUsersContext(context.Background())
+}
+
+// ReturnAllUsersContext is like ReturnAllUsers, with ctx for tracing and cancellation
+func ReturnAllUsersContext(ctx context.Context) []User {
+	ctx, end := startOperation(ctx, "ReturnAllUsers", "list_users")
+	defer end()
+
+	logger(ctx).Debug("reading users", "database", SQLFILE)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return nil
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users \n")
+	rows, err := db.QueryContext(ctx, userSelect)
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("query failed", "err", err)
 		return nil
 	}
+	defer rows.Close()
 
 	all := []User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
-		temp := User{c1, c2, c3, c4, c5, c6}
+		temp, err := scanUser(rows)
+		if err != nil {
+			logger(ctx).Error("cannot read row", "err", err)
+			return nil
+		}
 		all = append(all, temp)
 	}
 
-	log.Println("All:", all)
+	logger(ctx).Debug("users", "count", len(all))
 	return all
 }
 
+// FindUsersAttributesContext returns the users whose attributes have all
+// the given values. The names of filters are attribute names, with dots
+// between the names of nested attributes, and the values are compared
+// as text, with true and false for booleans.
+func FindUsersAttributesContext(ctx context.Context, filters map[string]string) ([]User, error) {
+	ctx, end := startOperation(ctx, "FindUsersAttributes", "list_users")
+	defer end()
+
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	where := []string{}
+	args := []interface{}{}
+	for _, name := range names {
+		path, err := attributePath(name)
+		if err != nil {
+			return nil, err
+		}
+		// json_extract returns JSON booleans as 1 and 0, so they
+		// are compared by their JSON text instead
+		where = append(where, "CASE json_type(Attributes, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' "+
+			"ELSE CAST(json_extract(Attributes, ?) AS TEXT) END = ?")
+		args = append(args, path, path, filters[name])
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := userSelect
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := []User{}
+	for rows.Next() {
+		temp, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, temp)
+	}
+	return all, rows.Err()
+}
+
 // FindUserID is for returning a user record defined by ID
 func FindUserID(ID int) User {
-	log.Println("Get User Data from SQLite3:", ID)
-	db, err := sql.Open("sqlite3", SQLFILE)
+	return FindUserIDContext(context.Background(), ID)
+}
+
+// FindUserIDContext is like FindUserID, with ctx for tracing and cancellation
+func FindUserIDContext(ctx context.Context, ID int) User {
+	ctx, end := startOperation(ctx, "FindUserID", "find_user")
+	defer end()
+
+	logger(ctx).Debug("finding user", "id", ID)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return User{}
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users where ID = $1 \n", ID)
+	rows, err := db.QueryContext(ctx, userSelect+" WHERE ID = $1", ID)
 	if err != nil {
-		log.Println("Query:", err)
+		logger(ctx).Error("query failed", "err", err)
 		return User{}
 	}
 	defer rows.Close()
 
 	u := User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
+		u, err = scanUser(rows)
 		if err != nil {
-			log.Println(err)
+			logger(ctx).Error("cannot read row", "err", err)
 			return User{}
 		}
-		u = User{c1, c2, c3, c4, c5, c6}
-		log.Println("Found user:", u)
+		logger(ctx).Debug("found user", "id", u.ID)
 	}
 	return u
 }
 
 // FindUserUsername is for returning a user record defined by username
 func FindUserUsername(username string) User {
-	log.Println("Get User Data from SQLite3:", username)
-	db, err := sql.Open("sqlite3", SQLFILE)
+	return FindUserUsernameContext(context.Background(), username)
+}
+
+// FindUserUsernameContext is like FindUserUsername, with ctx for tracing and cancellation
+func FindUserUsernameContext(ctx context.Context, username string) User {
+	ctx, end := startOperation(ctx, "FindUserUsername", "find_user")
+	defer end()
+
+	logger(ctx).Debug("finding user", "username", username)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return User{}
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users where Username = $1 \n", username)
+	rows, err := db.QueryContext(ctx, userSelect+" WHERE Username = $1", username)
 	if err != nil {
-		log.Println("FindUserUsername Query:", err)
+		logger(ctx).Error("query failed", "err", err)
 		return User{}
 	}
 	defer rows.Close()
 
 	u := User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
+		u, err = scanUser(rows)
 		if err != nil {
-			log.Println(err)
+			logger(ctx).Error("cannot read row", "err", err)
 			return User{}
 		}
-		u = User{c1, c2, c3, c4, c5, c6}
-		log.Println("Found user:", u)
+		logger(ctx).Debug("found user", "id", u.ID)
+	}
+	return u
+}
+
+// FindUserEmailContext returns the user with an email address,
+// which is compared in its normalized form
+func FindUserEmailContext(ctx context.Context, email string) User {
+	ctx, end := startOperation(ctx, "FindUserEmail", "find_user")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		logger(ctx).Error("cannot open database", "err", err)
+		return User{}
+	}
+
+	u, err := scanUser(db.QueryRowContext(ctx, userSelect+" WHERE Email <> '' AND Email = ?", normalizeEmail(email)))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger(ctx).Error("cannot find user", "err", err)
+		}
+		return User{}
 	}
 	return u
 }
 
 // ReturnLoggedUsers is for returning all logged in users
 func ReturnLoggedUsers() []User {
-	log.Println("Reading from SQLite3:", SQLFILE)
-	db, err := sql.Open("sqlite3", SQLFILE)
+	return ReturnLoggedUsersContext(context.Background())
+}
+
+// ReturnLoggedUsersContext is like ReturnLoggedUsers, with ctx for tracing and cancellation
+func ReturnLoggedUsersContext(ctx context.Context) []User {
+	ctx, end := startOperation(ctx, "ReturnLoggedUsers", "list_logged_users")
+	defer end()
+
+	logger(ctx).Debug("reading users", "database", SQLFILE)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return nil
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users WHERE Active = 1 \n")
+	rows, err := db.QueryContext(ctx, userSelect+" WHERE Active = 1")
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("query failed", "err", err)
 		return nil
 	}
+	defer rows.Close()
 
 	all := []User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
+		temp, err := scanUser(rows)
 		if err != nil {
-			log.Println(err)
+			logger(ctx).Error("cannot read row", "err", err)
 			return []User{}
 		}
-		temp := User{c1, c2, c3, c4, c5, c6}
-		log.Println("temp:", all)
 		all = append(all, temp)
 	}
 
-	log.Println("Logged in:", all)
+	logger(ctx).Debug("logged in users", "count", len(all))
 	return all
 }
 
 // IsUserAdmin determines whether a user is
 // an administrator or not
 func IsUserAdmin(u UserPass) bool {
+	return IsUserAdminContext(context.Background(), u)
+}
+
+// IsUserAdminContext is like IsUserAdmin, with ctx for tracing and cancellation
+func IsUserAdminContext(ctx context.Context, u UserPass) bool {
+	ctx, end := startOperation(ctx, "IsUserAdmin", "")
+	defer end()
+
 	err := u.Validate()
 	if err != nil {
-		log.Println("IsUserAdmin - Validate:", err)
+		logger(ctx).Info("invalid credentials", "err", err)
 		return false
 	}
 
-	db, err := sql.Open("sqlite3", SQLFILE)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return false
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users WHERE Username = $1 \n", u.Username)
+	rows, err := db.QueryContext(ctx, userSelect+" WHERE Username = $1", u.Username)
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("query failed", "err", err)
 		return false
 	}
+	defer rows.Close()
 
 	temp := User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	// If there exist multiple users with the same username,
 	// we will get the FIRST ONE only.
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
+		temp, err = scanUser(rows)
 		if err != nil {
-			log.Println(err)
+			logger(ctx).Error("cannot read row", "err", err)
 			return false
 		}
-		temp = User{c1, c2, c3, c4, c5, c6}
 	}
 
-	if u.Username == temp.Username && u.Password == temp.Password && temp.Admin == 1 {
+	if u.Username != temp.Username || !CheckPassword(temp.Password, u.Password) {
+		return false
+	}
+	temp = upgradePassword(ctx, temp, u.Password)
+	if temp.Admin == 1 {
+		setRequestUser(ctx, u.Username)
 		return true
 	}
 	return false
 }
 
+// upgradePassword replaces the plain text password of t, which a login
+// has just matched with password, by its hash and returns the new record.
+// A user that has changed since t was read keeps the changed record.
+func upgradePassword(ctx context.Context, t User, password string) User {
+	if IsPasswordHash(t.Password) {
+		return t
+	}
+
+	u := t
+	hash, err := HashPassword(password)
+	if err == nil {
+		u.Password = hash
+		var db *sql.DB
+		db, err = openDB()
+		if err == nil {
+			err = execUpdateUser(db, u, []string{"password"}, t.Version)
+		}
+	}
+	if err == ErrVersionMismatch {
+		return t
+	}
+	if err != nil {
+		logger(ctx).Error("cannot hash password", "id", t.ID, "err", err)
+		return t
+	}
+	u.Version++
+	return u
+}
+
+// FindUserLoginContext returns the user whose username is login or, when
+// there is none, whose verified email address is login
+func FindUserLoginContext(ctx context.Context, login string) User {
+	t := FindUserUsernameContext(ctx, login)
+	if t.Username == empty && strings.Contains(login, "@") {
+		t = FindUserEmailContext(ctx, login)
+		if t.EmailVerified != 1 {
+			return User{}
+		}
+	}
+	return t
+}
+
+// AuthenticateContext checks the credentials of u, whose Username can also
+// be the verified email address of the user, and returns the user
+func AuthenticateContext(ctx context.Context, u UserPass) (User, bool) {
+	ctx, end := startOperation(ctx, "Authenticate", "")
+	defer end()
+
+	err := u.Validate()
+	if err != nil {
+		logger(ctx).Info("invalid credentials", "err", err)
+		return User{}, false
+	}
+
+	t := FindUserLoginContext(ctx, u.Username)
+	if t.Username == empty || !CheckPassword(t.Password, u.Password) {
+		return User{}, false
+	}
+	t = upgradePassword(ctx, t, u.Password)
+	setRequestUser(ctx, t.Username)
+	return t, true
+}
+
 func IsUserValid(u UserPass) bool {
+	return IsUserValidContext(context.Background(), u)
+}
+
+// IsUserValidContext is like IsUserValid, with ctx for tracing and cancellation
+func IsUserValidContext(ctx context.Context, u UserPass) bool {
+	ctx, end := startOperation(ctx, "IsUserValid", "")
+	defer end()
+
 	err := u.Validate()
 	if err != nil {
-		log.Println("IsUserValid - Validate:", err)
+		logger(ctx).Info("invalid credentials", "err", err)
 		return false
 	}
 
-	db, err := sql.Open("sqlite3", SQLFILE)
+	db, err := openDB()
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot open database", "err", err)
 		return false
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users WHERE Username = $1 \n", u.Username)
+	rows, err := db.QueryContext(ctx, userSelect+" WHERE Username = $1", u.Username)
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("query failed", "err", err)
 		return false
 	}
+	defer rows.Close()
 
 	temp := User{}
-	var c1 int
-	var c2, c3 string
-	var c4 int64
-	var c5, c6 int
-
 	// If there exist multiple users with the same username,
 	// we will get the FIRST ONE only.
 	for rows.Next() {
-		err = rows.Scan(&c1, &c2, &c3, &c4, &c5, &c6)
+		temp, err = scanUser(rows)
 		if err != nil {
-			log.Println(err)
+			logger(ctx).Error("cannot read row", "err", err)
 			return false
 		}
-		temp = User{c1, c2, c3, c4, c5, c6}
 	}
 
-	if u.Username == temp.Username && u.Password == temp.Password {
+	if u.Username == temp.Username && CheckPassword(temp.Password, u.Password) {
+		upgradePassword(ctx, temp, u.Password)
+		setRequestUser(ctx, u.Username)
 		return true
 	}
 	return false
 }
-
-// Validate method validates the data of UserPass
-func (p *UserPass) Validate() error {
-	validate := validator.New()
-	return validate.Struct(p)
-}
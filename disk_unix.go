@@ -0,0 +1,16 @@
+//go:build unix
+
+package shandler
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to unprivileged users
+// on the file system of path
+func freeDiskSpace(path string) (uint64, error) {
+	var s syscall.Statfs_t
+	err := syscall.Statfs(path, &s)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(s.Bavail) * uint64(s.Bsize), nil
+}
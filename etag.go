@@ -0,0 +1,66 @@
+package shandler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// REQUIREIFMATCH defines whether requests that update or delete a user
+// must send an If-Match header. When false, If-Match is honored if present.
+var REQUIREIFMATCH = false
+
+// ETag returns the entity tag of a user record, which is based on its version
+func ETag(u User) string {
+	return `"` + strconv.FormatInt(u.Version, 10) + `"`
+}
+
+// etagList splits the value of an If-Match or If-None-Match header
+func etagList(h string) []string {
+	list := []string{}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t != empty {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// ifMatch checks the If-Match header of r against the stored record u.
+// It returns the version that the change must be applied to, where zero
+// means any version, and zero as the status. When the precondition fails,
+// it returns the HTTP status code that should be sent to the client.
+func ifMatch(r *http.Request, u User) (int64, int) {
+	return matchETag(r.Header.Get("If-Match"), u)
+}
+
+// matchETag implements ifMatch for the value h of an If-Match header
+func matchETag(h string, u User) (int64, int) {
+	if h == empty {
+		if REQUIREIFMATCH {
+			return 0, http.StatusPreconditionRequired
+		}
+		return 0, 0
+	}
+
+	// If-Match uses the strong comparison function, so weak
+	// entity tags never match
+	for _, t := range etagList(h) {
+		if t == "*" || t == ETag(u) {
+			return u.Version, 0
+		}
+	}
+	return 0, http.StatusPreconditionFailed
+}
+
+// notModified reports whether the If-None-Match header of r matches u
+func notModified(r *http.Request, u User) bool {
+	h := r.Header.Get("If-None-Match")
+	for _, t := range etagList(h) {
+		if t == "*" || strings.TrimPrefix(t, "W/") == ETag(u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package shandler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestETagConditionalRequests(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	etag := rw.Header().Get("ETag")
+	if etag == empty {
+		t.Fatal("response has no ETag")
+	}
+
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", adminAuth, "If-None-Match", etag)
+	expectStatus(t, rw, http.StatusNotModified)
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"admin":1}`,
+		"Authorization", adminAuth, "If-Match", `"999"`)
+	expectStatus(t, rw, http.StatusPreconditionFailed)
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"admin":1}`,
+		"Authorization", adminAuth, "If-Match", etag)
+	expectStatus(t, rw, http.StatusOK)
+	if rw.Header().Get("ETag") == etag {
+		t.Fatal("ETag did not change after an update")
+	}
+
+	rw = serve(h, http.MethodDelete, "/v3/users/2", empty, "Authorization", adminAuth, "If-Match", etag)
+	expectStatus(t, rw, http.StatusPreconditionFailed)
+}
+
+func TestLoginChangesETag(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	etag := rw.Header().Get("ETag")
+
+	logins := []struct {
+		path, body string
+	}{
+		{"/v1/login", `{"user":"alice","password":"alice-secret"}`},
+		{"/v1/logout", `{"user":"alice","password":"alice-secret"}`},
+		{"/v2/login", `{"username":"alice","password":"alice-secret"}`},
+		{"/v2/logout", `{"username":"alice","password":"alice-secret"}`},
+		{"/v3/sessions", `{"user":"alice","password":"alice-secret"}`},
+	}
+	for _, l := range logins {
+		rw = serve(h, http.MethodPost, l.path, l.body)
+		if rw.Code != http.StatusOK && rw.Code != http.StatusCreated {
+			t.Fatalf("%s: status = %d", l.path, rw.Code)
+		}
+
+		// A cached copy from before the login is stale
+		rw = serve(h, http.MethodGet, "/v1/username/2", empty, "If-None-Match", etag)
+		expectStatus(t, rw, http.StatusOK)
+		if rw.Header().Get("ETag") == etag {
+			t.Fatalf("%s: ETag %s did not change", l.path, etag)
+		}
+		etag = rw.Header().Get("ETag")
+	}
+
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", adminAuth, "If-None-Match", etag)
+	expectStatus(t, rw, http.StatusNotModified)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	var v UserView
+	decodeBody(t, rw, &v)
+	if v.Active != 1 || v.LastLogin == 0 {
+		t.Fatalf("login was not recorded: %+v", v)
+	}
+}
+
+func TestLoginKeepsConcurrentChanges(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	// The login reads alice before the update and
+	// must not write the old record back
+	u := FindUserUsername("alice")
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"admin":1}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+
+	u.LastLogin = 1
+	u.Active = 1
+	if !UpdateUserFields(u, []string{"lastlogin", "active"}) {
+		t.Fatal("cannot update user")
+	}
+	if FindUserUsername("alice").Admin != 1 {
+		t.Fatal("login reverted a concurrent update")
+	}
+}
@@ -18,8 +18,6 @@ package shandler
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -76,41 +74,47 @@ func TimeHandler(rw http.ResponseWriter, r *http.Request) {
 // responses:
 //	200: OK
 //  400: BadRequest
+//	403: V3Error
+//	422: V3Error
 
 // AddHandler is for adding a new user /v1/add
 func AddHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
+	var users = []inputBody{}
+	err := decodeJSON(r, &users)
 	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if len(d) == 0 {
+	if len(users) != 2 {
+		logger(r.Context()).Info("expected an administrator and a user", "count", len(users))
 		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
 		return
 	}
 
-	var users = []Input{}
-	err = json.Unmarshal(d, &users)
-	if err != nil {
-		log.Println(err)
+	logger(r.Context()).Debug("request", "username", users[0].Username, "target", users[1].Username)
+
+	u := UserPass{users[0].Username, users[0].Password}
+	caller, ok := adminCaller(r.Context(), u)
+	if !ok {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", u.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	log.Println(users)
-
-	u := UserPass{users[0].Username, users[0].Password}
-	if !IsUserAdmin(u) {
-		log.Println("Command issued by non-admin user:", u.Username)
-		rw.WriteHeader(http.StatusBadRequest)
+	in := UserCreate{Username: users[1].Username, Password: users[1].Password, Admin: users[1].Admin}
+	err = checkWritable(caller.Role(), append(in.fields(), users[1].serverFieldValues.fields()...))
+	if err != nil {
+		writePermissionError(rw, r, ValidationError{}.add("[1].", err))
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, ValidationError{}.add("[1].", err))
 		return
 	}
 
-	newUser := User{-1, users[1].Username, users[1].Password, time.Now().Unix(), users[1].Admin, 0}
-	result := AddUser(newUser)
+	result := AddUserContext(r.Context(), in.NewUser())
 	if !result {
 		rw.WriteHeader(http.StatusBadRequest)
 	}
@@ -120,41 +124,51 @@ func AddHandler(rw http.ResponseWriter, r *http.Request) {
 func DeleteHandler(rw http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"]
 	if !ok {
-		log.Println("ID value not set!")
+		logger(r.Context()).Info("user ID not set")
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	var user = UserPass{}
-	err := user.FromJSON(r.Body)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if !IsUserAdmin(user) {
-		log.Println("User", user.Username, "is not admin!")
+	if !IsUserAdminContext(r.Context(), user) {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	intID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Println("id", err)
+		logger(r.Context()).Info("invalid user ID", "err", err)
 		return
 	}
 
-	t := FindUserID(intID)
+	t := FindUserIDContext(r.Context(), intID)
 	if t.Username != "" {
-		log.Println("About to delete:", t)
-		deleted := DeleteUser(intID)
-		if deleted {
-			log.Println("User deleted:", id)
+		version, status := ifMatch(r, t)
+		if status != 0 {
+			logger(r.Context()).Info("precondition failed", "id", id)
+			rw.WriteHeader(status)
+			return
+		}
+
+		logger(r.Context()).Debug("deleting user", "id", t.ID)
+		err := deleteUser(r.Context(), intID, version)
+		if err == nil {
+			logger(r.Context()).Info("user deleted", "id", id)
 			rw.WriteHeader(http.StatusOK)
 			return
+		} else if err == ErrVersionMismatch {
+			logger(r.Context()).Info("user has been modified", "id", id)
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
 		} else {
-			log.Println("Cannot delete user:", id)
+			logger(r.Context()).Error("cannot delete user", "id", id, "err", err)
 			rw.WriteHeader(http.StatusNotFound)
 		}
 	}
@@ -163,36 +177,22 @@ func DeleteHandler(rw http.ResponseWriter, r *http.Request) {
 
 // GetAllHandler is for getting all data from the user database
 func GetAllHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var user = UserPass{}
-	err = json.Unmarshal(d, &user)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if !IsUserValid(user) {
-		log.Println("User", user, "does not exist!")
+	if !IsUserValidContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = SliceToJSON(ReturnAllUsers(), rw)
+	err = SliceToJSON(Views(ReturnAllUsersContext(r.Context())), rw)
 	if err != nil {
-		log.Println(err)
+		logger(r.Context()).Error("cannot write response", "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -207,65 +207,61 @@ func GetAllHandler(rw http.ResponseWriter, r *http.Request) {
 
 // GetIDHandler returns the ID of an existing user
 func GetIDHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var user = UserPass{}
-	err = json.Unmarshal(d, &user)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	log.Println("Input user:", user)
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "not valid!")
+	logger(r.Context()).Debug("request", "username", user.Username)
+	if !IsUserValidContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserUsername(user.Username)
+	t := FindUserUsernameContext(r.Context(), user.Username)
 	Body := "User " + user.Username + " has ID:"
 	fmt.Fprintf(rw, "%s %d\n", Body, t.ID)
 }
 
-// GetUserDataHandler + GET returns the full record of a user
+// GetUserDataHandler + GET returns the record of a user. It is not
+// authenticated, so the email address and attributes are left out.
 func GetUserDataHandler(rw http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"]
 	if !ok {
-		log.Println("ID value not set!")
+		logger(r.Context()).Info("user ID not set")
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	intID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Println("id", err)
+		logger(r.Context()).Info("invalid user ID", "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserID(intID)
+	t := FindUserIDContext(r.Context(), intID)
 	if t.Username != "" {
-		err := t.ToJSON(rw)
+		rw.Header().Set("ETag", ETag(t))
+		if notModified(r, t) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		v := t.View()
+		v.Email = empty
+		v.Attributes = nil
+		err := json.NewEncoder(rw).Encode(v)
 		if err != nil {
 			rw.WriteHeader(http.StatusBadRequest)
-			log.Println(err)
+			logger(r.Context()).Error("cannot write response", "err", err)
 			return
 		}
 	} else {
-		log.Println("User not found:", id)
+		logger(r.Context()).Info("user not found", "id", id)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -273,43 +269,68 @@ func GetUserDataHandler(rw http.ResponseWriter, r *http.Request) {
 
 // UpdateHandler is for updating the data of an existing user + PUT
 func UpdateHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
+	var users = []inputBody{}
+	err := decodeJSON(r, &users)
 	if err != nil {
+		writeBodyError(rw, r, err)
+		return
+	}
+
+	if len(users) != 2 {
+		logger(r.Context()).Info("expected an administrator and a user", "count", len(users))
 		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
 		return
 	}
 
-	if len(d) == 0 {
+	u := UserPass{users[0].Username, users[0].Password}
+	caller, ok := adminCaller(r.Context(), u)
+	if !ok {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", u.Username)
 		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
 		return
 	}
 
-	var users = []Input{}
-	err = json.Unmarshal(d, &users)
+	// users[1] names the user to update, so only its password and
+	// admin fields change
+	update := UserUpdate{Password: &users[1].Password, Admin: &users[1].Admin}
+	err = checkWritable(caller.Role(), append(update.fields(), users[1].serverFieldValues.fields()...))
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writePermissionError(rw, r, ValidationError{}.add("[1].", err))
+		return
+	}
+	err = users[1].Validate()
+	if err != nil {
+		writeValidationError(rw, r, ValidationError{}.add("[1].", err))
 		return
 	}
 
-	u := UserPass{users[0].Username, users[0].Password}
-	if !IsUserAdmin(u) {
-		log.Println("Command issued by non-admin user:", u.Username)
-		rw.WriteHeader(http.StatusBadRequest)
+	logger(r.Context()).Debug("request", "username", users[0].Username, "target", users[1].Username)
+	t := FindUserUsernameContext(r.Context(), users[1].Username)
+	version, status := ifMatch(r, t)
+	if status != 0 {
+		logger(r.Context()).Info("precondition failed", "id", t.ID)
+		rw.WriteHeader(status)
 		return
 	}
 
-	log.Println(users)
-	t := FindUserUsername(users[1].Username)
-	t.Username = users[1].Username
-	t.Password = users[1].Password
-	t.Admin = users[1].Admin
+	newPassword := !CheckPassword(t.Password, *update.Password)
+	t.Password = *update.Password
+	t.Admin = *update.Admin
 
-	if !UpdateUser(t) {
-		log.Println("Update failed:", t)
+	err = updateUser(r.Context(), t, update.fields(), version)
+	if err == ErrVersionMismatch {
+		logger(r.Context()).Info("user has been modified", "id", t.ID)
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot update user", "id", t.ID, "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// A new password logs the user out, as with PATCH /v3/users/{id}
+	if newPassword {
+		passwordChanged(r, caller, t.ID)
 	}
 }
 
@@ -323,44 +344,31 @@ func UpdateHandler(rw http.ResponseWriter, r *http.Request) {
 // LoginHandler is for updating the LastLogin time of a user
 // And changing the Active field to true
 func LoginHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var user = UserPass{}
-	err = json.Unmarshal(d, &user)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	log.Println("Input user:", user)
+	logger(r.Context()).Debug("request", "username", user.Username)
 
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "not valid!")
+	t, valid := AuthenticateContext(r.Context(), user)
+	countLogin(valid)
+	if !valid {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserUsername(user.Username)
-	log.Println("Logging in:", t)
+	logger(r.Context()).Debug("logging in", "id", t.ID)
 
 	t.LastLogin = time.Now().Unix()
 	t.Active = 1
-	if UpdateUser(t) {
-		log.Println("User updated:", t)
+	if UpdateUserFieldsContext(r.Context(), t, []string{"lastlogin", "active"}) {
+		logger(r.Context()).Info("user logged in", "id", t.ID)
 	} else {
-		log.Println("Update failed:", t)
+		logger(r.Context()).Error("cannot update user", "id", t.ID)
 		rw.WriteHeader(http.StatusBadRequest)
 	}
 }
@@ -375,40 +383,26 @@ func LoginHandler(rw http.ResponseWriter, r *http.Request) {
 // LogoutHandler is for logging out a user
 // And changing the Active field to false
 func LogoutHandler(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var user = UserPass{}
-	err = json.Unmarshal(d, &user)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "exists!")
+	if !IsUserValidContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid credentials", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserUsername(user.Username)
-	log.Println("Logging out:", t.Username)
-	t.Active = 0
-	if UpdateUser(t) {
-		log.Println("User updated:", t)
+	t := FindUserUsernameContext(r.Context(), user.Username)
+	logger(r.Context()).Debug("logging out", "id", t.ID)
+	err = logoutUser(r.Context(), t)
+	if err == nil {
+		logger(r.Context()).Info("user logged out", "id", t.ID)
 	} else {
-		log.Println("Update failed:", t)
+		logger(r.Context()).Error("cannot log out user", "id", t.ID, "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 	}
 }
@@ -423,23 +417,21 @@ func LogoutHandler(rw http.ResponseWriter, r *http.Request) {
 // LoggedUsersHandler returns the list of currently logged in users
 func LoggedUsersHandler(rw http.ResponseWriter, r *http.Request) {
 	var user = UserPass{}
-	err := user.FromJSON(r.Body)
-
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "exists!")
+	if !IsUserValidContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid credentials", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = SliceToJSON(ReturnLoggedUsers(), rw)
+	err = SliceToJSON(Views(ReturnLoggedUsersContext(r.Context())), rw)
 	if err != nil {
-		log.Println(err)
+		logger(r.Context()).Error("cannot write response", "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -0,0 +1,190 @@
+package shandler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// adminAuth authenticates requests as the administrator of CreateDatabase
+var adminAuth = basicAuth("admin", "admin")
+
+// basicAuth returns the Authorization header of username and password
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// newTestServer creates a database that only has the administrator
+// and returns the router of the server
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	SQLFILE = filepath.Join(t.TempDir(), "users.db")
+	IMAGESPATH = t.TempDir()
+	rateLimitStore = NewMemoryRateLimitStore()
+	SetRateLimiter(NewRateLimiter(DefaultConfig().RateLimits, rateLimitStore))
+	newAdminPassword = func() (string, error) { return "admin", nil }
+	defer func() { newAdminPassword = NewPassword }()
+	if _, ok := CreateDatabase(); !ok {
+		t.Fatal("cannot create database")
+	}
+	t.Cleanup(func() {
+		notifying.Wait()
+		CloseDatabase()
+	})
+	return NewRouter()
+}
+
+// serve sends a request to h and returns the response. header is a list
+// of names and values. Bodies are sent as JSON unless header says otherwise.
+func serve(h http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != empty {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+// expectStatus fails t when rw does not have status
+func expectStatus(t *testing.T, rw *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rw.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rw.Code, status, strings.TrimSpace(rw.Body.String()))
+	}
+}
+
+// decodeBody decodes the JSON body of rw into v
+func decodeBody(t *testing.T, rw *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.Unmarshal(rw.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("invalid JSON body %q: %v", rw.Body.String(), err)
+	}
+}
+
+// expectNoPassword fails t when any object in the JSON body of rw
+// has a password key
+func expectNoPassword(t *testing.T, rw *httptest.ResponseRecorder) {
+	t.Helper()
+	var v interface{}
+	decodeBody(t, rw, &v)
+	if hasKey(v, "password") {
+		t.Fatalf("response has a password: %s", rw.Body.String())
+	}
+}
+
+// hasKey returns true when key is in any object of v
+func hasKey(v interface{}, key string) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if k == key || hasKey(e, key) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if hasKey(e, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestV1ResponsesHaveNoPassword(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v1/add",
+		`[{"user":"admin","password":"admin"},{"user":"alice","password":"alice-secret","admin":0}]`)
+	expectStatus(t, rw, http.StatusOK)
+
+	rw = serve(h, http.MethodGet, "/v1/getall", `{"user":"admin","password":"admin"}`)
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+
+	rw = serve(h, http.MethodGet, "/v1/username/2", empty)
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+}
+
+func TestV2ResponsesHaveNoPassword(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v2/add",
+		`{"username":"admin","password":"admin","load":{"user":"alice","password":"alice-secret"}}`)
+	expectStatus(t, rw, http.StatusOK)
+
+	rw = serve(h, http.MethodGet, "/v2/getall", `{"username":"admin","password":"admin"}`)
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+}
+
+func TestV3ResponsesHaveNoPassword(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	expectNoPassword(t, rw)
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"password":"alice-secret-2"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+
+	rw = serve(h, http.MethodGet, "/v3/users", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", basicAuth("alice", "alice-secret-2"))
+	expectStatus(t, rw, http.StatusOK)
+	expectNoPassword(t, rw)
+}
+
+// captureLogs writes the logs of the test to the returned buffer as JSON
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	logs := &bytes.Buffer{}
+	err := SetupLogging(logs, LogJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetupLogging(os.Stderr, LogText, slog.LevelInfo) })
+	return logs
+}
+
+func TestInvalidCredentialsLog(t *testing.T) {
+	h := newTestServer(t)
+	logs := captureLogs(t)
+
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/v1/logout", `{"user":"admin","password":"wrong"}`},
+		{http.MethodGet, "/v1/logged", `{"user":"admin","password":"wrong"}`},
+		{http.MethodPost, "/v2/logout", `{"username":"admin","password":"wrong"}`},
+	}
+	for _, r := range requests {
+		logs.Reset()
+		rw := serve(h, r.method, r.path, r.body)
+		expectStatus(t, rw, http.StatusBadRequest)
+		if !strings.Contains(logs.String(), `"level":"WARN","msg":"invalid credentials"`) {
+			t.Fatalf("%s: logs = %s", r.path, logs.String())
+		}
+		if strings.Contains(logs.String(), "already exists") {
+			t.Fatalf("%s: logs = %s", r.path, logs.String())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package shandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MINFREEDISK is the free disk space in megabytes below which
+// the server is not ready
+var MINFREEDISK = 100
+
+// CHECKTIMEOUT is how long /readyz waits for each check
+var CHECKTIMEOUT = 2 * time.Second
+
+// Checker is a dependency that must work for the server to be ready
+type Checker interface {
+	// Name identifies the check in the response of /readyz
+	Name() string
+	// Check returns nil when the dependency works
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to the Checker interface
+type CheckerFunc struct {
+	CheckName string
+	F         func(ctx context.Context) error
+}
+
+// Name implements Checker
+func (c CheckerFunc) Name() string {
+	return c.CheckName
+}
+
+// Check implements Checker
+func (c CheckerFunc) Check(ctx context.Context) error {
+	return c.F(ctx)
+}
+
+var (
+	// checkersMutex protects checkers
+	checkersMutex sync.Mutex
+	// checkers are run by /readyz in order
+	checkers = []Checker{
+		CheckerFunc{"database", checkDatabaseReachable},
+		CheckerFunc{"migrations", checkMigrations},
+		CheckerFunc{"images", checkImagesWritable},
+		CheckerFunc{"disk", checkFreeDisk},
+	}
+)
+
+// RegisterChecker adds c to the checks of /readyz
+func RegisterChecker(c Checker) {
+	checkersMutex.Lock()
+	defer checkersMutex.Unlock()
+	checkers = append(checkers, c)
+}
+
+// CheckResult is the result of a single check
+// swagger:model CheckResult
+type CheckResult struct {
+	// The name of the check
+	//
+	// required: true
+	Name string `json:"name"`
+	// Either ok or fail
+	//
+	// required: true
+	Status string `json:"status"`
+	// Why the check failed
+	//
+	// required: false
+	Error string `json:"error,omitempty"`
+	// How long the check took in milliseconds
+	//
+	// required: true
+	Duration float64 `json:"duration_ms"`
+}
+
+// Health is the body of /healthz and /readyz
+// swagger:model Health
+type Health struct {
+	// Either ok or fail
+	//
+	// required: true
+	Status string `json:"status"`
+	// The result of every check, only returned by /readyz
+	//
+	// required: false
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+// RunChecks runs every registered check and returns the results.
+// The checks run concurrently and each one has CHECKTIMEOUT to finish.
+func RunChecks(ctx context.Context) Health {
+	checkersMutex.Lock()
+	list := append([]Checker{}, checkers...)
+	checkersMutex.Unlock()
+
+	h := Health{Status: "ok", Checks: make([]CheckResult, len(list))}
+	var wg sync.WaitGroup
+	for i, c := range list {
+		wg.Add(1)
+		go func(i int, c Checker) {
+			defer wg.Done()
+			h.Checks[i] = runCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range h.Checks {
+		if c.Status != "ok" {
+			h.Status = "fail"
+		}
+	}
+	return h
+}
+
+// runCheck runs c with a deadline, so that a check that hangs fails
+// instead of blocking the response
+func runCheck(ctx context.Context, c Checker) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, CHECKTIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{Name: c.Name(), Status: "ok"}
+	result.Duration = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkDatabaseReachable checks that the database can be queried
+func checkDatabaseReachable(ctx context.Context) error {
+	if _, err := os.Stat(SQLFILE); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+// checkMigrations checks that the schema of the database is current
+func checkMigrations(ctx context.Context) error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != LatestSchemaVersion() {
+		return errors.New("schema version " + strconv.Itoa(version) +
+			", expected " + strconv.Itoa(LatestSchemaVersion()))
+	}
+	return nil
+}
+
+// checkImagesWritable checks that files can be uploaded to IMAGESPATH
+func checkImagesWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(IMAGESPATH, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkFreeDisk checks that the file systems of IMAGESPATH and of
+// the database have at least MINFREEDISK megabytes available
+func checkFreeDisk(ctx context.Context) error {
+	for _, path := range []string{IMAGESPATH, filepath.Dir(SQLFILE)} {
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < uint64(MINFREEDISK)<<20 {
+			return errors.New(path + ": " + strconv.FormatUint(free>>20, 10) +
+				" MB free, minimum " + strconv.Itoa(MINFREEDISK) + " MB")
+		}
+	}
+	return nil
+}
+
+// swagger:route GET /healthz health NULL
+// Return whether the process is up
+//
+// responses:
+//	200: Health
+
+// HealthzHandler is for handling /healthz.
+// It does not check any dependency, so it only fails when the process hangs.
+func HealthzHandler(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, Health{Status: "ok"})
+}
+
+// swagger:route GET /readyz health NULL
+// Return whether the server can handle requests
+//
+// responses:
+//	200: Health
+//	503: Health
+
+// ReadyzHandler is for handling /readyz.
+// It returns 503 when any check fails, so that no traffic is sent to
+// an instance whose database or disk does not work.
+func ReadyzHandler(rw http.ResponseWriter, r *http.Request) {
+	h := RunChecks(r.Context())
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSON(rw, status, h)
+}
@@ -0,0 +1,94 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readyz returns the response of /readyz and its checks by name
+func readyz(t *testing.T, h http.Handler, status int) map[string]CheckResult {
+	t.Helper()
+	rw := serve(h, http.MethodGet, "/readyz", empty)
+	expectStatus(t, rw, status)
+	if rw.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Cache-Control = %q", rw.Header().Get("Cache-Control"))
+	}
+	var health Health
+	decodeBody(t, rw, &health)
+	checks := map[string]CheckResult{}
+	for _, c := range health.Checks {
+		checks[c.Name] = c
+	}
+	return checks
+}
+
+func TestReadyz(t *testing.T) {
+	h := newTestServer(t)
+	minFree := MINFREEDISK
+	MINFREEDISK = 0
+	t.Cleanup(func() { MINFREEDISK = minFree })
+
+	checks := readyz(t, h, http.StatusOK)
+	for _, name := range []string{"database", "migrations", "images", "disk"} {
+		if checks[name].Status != "ok" {
+			t.Fatalf("%s = %+v", name, checks[name])
+		}
+	}
+
+	// Every failure is reported, and the other checks still pass
+	images := IMAGESPATH
+	IMAGESPATH = filepath.Join(t.TempDir(), "missing")
+	MINFREEDISK = 1 << 30
+	checks = readyz(t, h, http.StatusServiceUnavailable)
+	if checks["images"].Status != "fail" || checks["images"].Error == empty {
+		t.Fatalf("images = %+v", checks["images"])
+	}
+	if checks["disk"].Status != "fail" || checks["database"].Status != "ok" {
+		t.Fatalf("checks = %+v", checks)
+	}
+	IMAGESPATH = images
+	MINFREEDISK = 0
+
+	rw := serve(h, http.MethodGet, "/healthz", empty)
+	expectStatus(t, rw, http.StatusOK)
+}
+
+func TestReadyzCheckTimeout(t *testing.T) {
+	h := newTestServer(t)
+	minFree, timeout := MINFREEDISK, CHECKTIMEOUT
+	MINFREEDISK = 0
+	CHECKTIMEOUT = 50 * time.Millisecond
+	checkersMutex.Lock()
+	list := checkers
+	checkersMutex.Unlock()
+	t.Cleanup(func() {
+		MINFREEDISK, CHECKTIMEOUT = minFree, timeout
+		checkersMutex.Lock()
+		checkers = list
+		checkersMutex.Unlock()
+	})
+
+	// A check that hangs fails instead of blocking the response
+	release := make(chan struct{})
+	defer close(release)
+	RegisterChecker(CheckerFunc{"queue", func(ctx context.Context) error {
+		<-release
+		return nil
+	}})
+
+	start := time.Now()
+	checks := readyz(t, h, http.StatusServiceUnavailable)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("/readyz took %v", time.Since(start))
+	}
+	if checks["queue"].Status != "fail" || !strings.Contains(checks["queue"].Error, "deadline") {
+		t.Fatalf("queue = %+v", checks["queue"])
+	}
+	if checks["database"].Status != "ok" {
+		t.Fatalf("database = %+v", checks["database"])
+	}
+}
@@ -0,0 +1,673 @@
+package shandler
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatJSONL is the JSON Lines format of import and export
+	FormatJSONL = "jsonl"
+	// FormatCSV is the CSV format of import and export
+	FormatCSV = "csv"
+)
+
+const (
+	// ConflictFail aborts an import when a username already exists
+	ConflictFail = "fail"
+	// ConflictSkip ignores the rows of usernames that already exist
+	ConflictSkip = "skip"
+	// ConflictOverwrite updates the users that already exist
+	ConflictOverwrite = "overwrite"
+)
+
+// exportColumns defines the CSV header of an export, which has the
+// fields of UserView
+var exportColumns = []string{"id", "user", "email", "email_verified", "lastlogin", "admin", "active", "version", "attributes"}
+
+// importColumns defines the CSV columns that an import accepts: the
+// columns of an export and the passwords. id, email_verified and version
+// are set by the server, so their values are ignored.
+var importColumns = map[string]bool{
+	"id": true, "user": true, "password": true, "password_hash": true, "email": true,
+	"email_verified": true, "lastlogin": true, "admin": true, "active": true,
+	"version": true, "attributes": true,
+}
+
+// ImportRecord defines a single user of an import
+// swagger:model ImportRecord
+type ImportRecord struct {
+	// The Username of the User
+	//
+	// required: true
+	Username string `json:"user"`
+	// The plain text Password of the User
+	//
+	// required: false
+	Password string `json:"password"`
+	// A bcrypt hash of the Password, used instead of password
+	//
+	// required: false
+	PasswordHash string `json:"password_hash"`
+	// The Email address of the User
+	//
+	// required: false
+	Email string `json:"email"`
+	// Is the User Admin or not
+	//
+	// required: false
+	Admin int `json:"admin"`
+	// Is the User Logged In or Not
+	//
+	// required: false
+	Active int `json:"active"`
+	// The Last Login time of the User, the time of the import when missing
+	//
+	// required: false
+	LastLogin int64 `json:"lastlogin"`
+	// The profile Attributes of the User, a JSON object that follows
+	// the attributes schema
+	//
+	// required: false
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+	// The ID of an exported User, which is ignored
+	//
+	// required: false
+	ID int `json:"id"`
+	// The email_verified field of an exported User, which is ignored
+	//
+	// required: false
+	EmailVerified int `json:"email_verified"`
+	// The Version of an exported User, which is ignored
+	//
+	// required: false
+	Version int64 `json:"version"`
+}
+
+// ImportOptions defines how an import is executed
+type ImportOptions struct {
+	// DryRun validates every row and rolls back all changes
+	DryRun bool
+	// OnConflict is one of ConflictFail, ConflictSkip and ConflictOverwrite
+	OnConflict string
+}
+
+// ImportRow defines the outcome of a single row of an import
+// swagger:model ImportRow
+type ImportRow struct {
+	// The number of the row, starting from 1
+	//
+	// required: true
+	Row int `json:"row"`
+	// The Username of the row
+	//
+	// required: true
+	Username string `json:"user"`
+	// One of created, updated, skipped, invalid and conflict
+	//
+	// required: true
+	Action string `json:"action"`
+	// The validation errors of the row
+	//
+	// required: false
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport defines the body returned by POST /v3/users/import
+// swagger:model ImportReport
+type ImportReport struct {
+	// Whether the import was a dry run
+	//
+	// required: true
+	DryRun bool `json:"dryrun"`
+	// Whether the changes have been saved
+	//
+	// required: true
+	Committed bool `json:"committed"`
+	// The number of created users
+	//
+	// required: true
+	Created int `json:"created"`
+	// The number of updated users
+	//
+	// required: true
+	Updated int `json:"updated"`
+	// The number of skipped rows
+	//
+	// required: true
+	Skipped int `json:"skipped"`
+	// The number of invalid rows
+	//
+	// required: true
+	Invalid int `json:"invalid"`
+	// The outcome of every row
+	//
+	// required: true
+	Rows []ImportRow `json:"rows"`
+}
+
+// ExportUsers writes every user to w in the given format, one row at a time.
+// Passwords are never exported.
+func ExportUsers(w io.Writer, format string) error {
+	return ExportUsersContext(context.Background(), w, format)
+}
+
+// ExportUsersContext is like ExportUsers, with ctx for tracing and cancellation
+func ExportUsersContext(ctx context.Context, w io.Writer, format string) error {
+	ctx, end := startOperation(ctx, "ExportUsers", "export_users")
+	defer end()
+
+	if format != FormatJSONL && format != FormatCSV {
+		return errors.New("unknown format " + strconv.Quote(format))
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, userSelect+" ORDER BY ID")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	e := json.NewEncoder(w)
+	c := csv.NewWriter(w)
+	if format == FormatCSV {
+		err = c.Write(exportColumns)
+		if err != nil {
+			return err
+		}
+	}
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+
+		if format == FormatJSONL {
+			err = e.Encode(u.View())
+		} else {
+			var attributes string
+			attributes, err = storedAttributes(u.Attributes)
+			if err != nil {
+				return err
+			}
+			err = c.Write([]string{
+				strconv.Itoa(u.ID), u.Username, u.Email, strconv.Itoa(u.EmailVerified),
+				strconv.FormatInt(u.LastLogin, 10), strconv.Itoa(u.Admin), strconv.Itoa(u.Active),
+				strconv.FormatInt(u.Version, 10), attributes,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Flush()
+	if err = c.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// importReader returns the records of an import one at a time.
+// It returns io.EOF when there are no more records.
+type importReader func() (ImportRecord, error)
+
+// errInvalidRecord wraps the errors of records that cannot be parsed,
+// which are reported for the row instead of aborting the import
+type errInvalidRecord struct {
+	err error
+}
+
+func (e errInvalidRecord) Error() string {
+	return e.err.Error()
+}
+
+// jsonlReader returns an importReader for JSON Lines
+func jsonlReader(r io.Reader) importReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	return func() (ImportRecord, error) {
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == empty {
+				continue
+			}
+
+			rec := ImportRecord{}
+			err := decodeStrict(strings.NewReader(line), &rec)
+			if err != nil {
+				return ImportRecord{}, errInvalidRecord{err}
+			}
+			return rec, nil
+		}
+
+		if err := s.Err(); err != nil {
+			return ImportRecord{}, err
+		}
+		return ImportRecord{}, io.EOF
+	}
+}
+
+// csvReader returns an importReader for CSV with a header row
+func csvReader(r io.Reader) (importReader, error) {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = 0
+	header, err := c.Read()
+	if err != nil {
+		return nil, errors.New("cannot read CSV header: " + err.Error())
+	}
+
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(h))
+		if !importColumns[header[i]] {
+			return nil, errors.New("unknown CSV column " + strconv.Quote(h))
+		}
+	}
+
+	return func() (ImportRecord, error) {
+		fields, err := c.Read()
+		if err == io.EOF {
+			return ImportRecord{}, io.EOF
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				return ImportRecord{}, errInvalidRecord{err}
+			}
+			return ImportRecord{}, err
+		}
+
+		rec := ImportRecord{}
+		for i, v := range fields {
+			v = strings.TrimSpace(v)
+			switch header[i] {
+			case "user":
+				rec.Username = v
+			case "password":
+				rec.Password = v
+			case "password_hash":
+				rec.PasswordHash = v
+			case "email":
+				rec.Email = v
+			case "admin", "active":
+				n := 0
+				if v != empty {
+					n, err = strconv.Atoi(v)
+					if err != nil {
+						return ImportRecord{}, errInvalidRecord{errors.New(header[i] + " must be 0 or 1")}
+					}
+				}
+				if header[i] == "admin" {
+					rec.Admin = n
+				} else {
+					rec.Active = n
+				}
+			case "lastlogin":
+				if v != empty {
+					rec.LastLogin, err = strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						return ImportRecord{}, errInvalidRecord{errors.New("lastlogin must be a Unix time")}
+					}
+				}
+			case "attributes":
+				if v != empty {
+					rec.Attributes = json.RawMessage(v)
+				}
+			}
+		}
+		return rec, nil
+	}, nil
+}
+
+// validateImportRecord returns the validation errors of rec, which
+// follows the rules of User, apart from password_hash. The password is
+// only required for new users, which the import checks later.
+func validateImportRecord(rec ImportRecord) []string {
+	errs := []string{}
+	if rec.Password != empty && rec.PasswordHash != empty {
+		errs = append(errs, "password and password_hash cannot be used together")
+	}
+	if rec.PasswordHash != empty && !IsPasswordHash(rec.PasswordHash) {
+		errs = append(errs, "password_hash is not a bcrypt hash")
+	}
+
+	u := User{Username: rec.Username, Password: rec.Password, Email: rec.Email,
+		LastLogin: rec.LastLogin, Admin: rec.Admin, Active: rec.Active, Attributes: rec.Attributes}
+	fields := []string{"user", "email", "lastlogin", "admin", "active"}
+	if rec.Password != empty {
+		fields = append(fields, "password")
+	}
+	if len(rec.Attributes) != 0 {
+		fields = append(fields, "attributes")
+	}
+	for _, v := range (ValidationError{}).add(empty, validateChanges(u, fields)) {
+		errs = append(errs, v.Field+" "+v.Message)
+	}
+	return errs
+}
+
+// importRequestError turns an error that the request of an import
+// caused into a *bodyError, which tells it apart from database errors
+func importRequestError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return describeJSONError(err)
+	}
+	return &bodyError{http.StatusBadRequest, err.Error()}
+}
+
+// passwordChange is a user whose password an import or a batch has changed,
+// with the number of sessions that it deleted
+type passwordChange struct {
+	userID  int
+	revoked int64
+}
+
+// importEntry is a row of an import that has been read and validated,
+// with the User that it creates or overwrites
+type importEntry struct {
+	row  ImportRow
+	rec  ImportRecord
+	user User
+}
+
+// ImportUsers reads users in the given format from r and adds them to the
+// database in a single transaction. Invalid rows are reported and ignored.
+// The transaction is rolled back for a dry run and when a conflict happens
+// with ConflictFail. Options and input that cannot be imported at all are
+// *bodyError values.
+func ImportUsers(r io.Reader, format string, opts ImportOptions) (ImportReport, error) {
+	return ImportUsersContext(context.Background(), r, format, opts)
+}
+
+// ImportUsersContext is like ImportUsers, with ctx for tracing and cancellation
+func ImportUsersContext(ctx context.Context, r io.Reader, format string, opts ImportOptions) (ImportReport, error) {
+	ctx, end := startOperation(ctx, "ImportUsers", "import_users")
+	defer end()
+
+	report := ImportReport{DryRun: opts.DryRun, Rows: []ImportRow{}}
+	switch opts.OnConflict {
+	case empty:
+		opts.OnConflict = ConflictFail
+	case ConflictFail, ConflictSkip, ConflictOverwrite:
+	default:
+		return report, &bodyError{http.StatusBadRequest, "unknown conflict strategy " + strconv.Quote(opts.OnConflict)}
+	}
+
+	var next importReader
+	switch format {
+	case FormatJSONL:
+		next = jsonlReader(r)
+	case FormatCSV:
+		var err error
+		next, err = csvReader(r)
+		if err != nil {
+			return report, importRequestError(err)
+		}
+	default:
+		return report, &bodyError{http.StatusBadRequest, "unknown format " + strconv.Quote(format)}
+	}
+
+	// Hashing is slow, so every row is read, validated and hashed before
+	// the transaction, which holds the write lock of the database
+	entries := []importEntry{}
+	for n := 1; ; n++ {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+
+		row := ImportRow{Row: n, Username: rec.Username}
+		if err != nil {
+			if _, ok := err.(errInvalidRecord); !ok {
+				return report, importRequestError(err)
+			}
+			row.Action = "invalid"
+			row.Errors = []string{err.Error()}
+			entries = append(entries, importEntry{row: row})
+			continue
+		}
+
+		if rec.LastLogin == 0 {
+			rec.LastLogin = time.Now().Unix()
+		}
+		row.Errors = validateImportRecord(rec)
+		if len(row.Errors) != 0 {
+			row.Action = "invalid"
+			entries = append(entries, importEntry{row: row})
+			continue
+		}
+
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		u := User{Username: rec.Username, Password: rec.PasswordHash, Email: rec.Email,
+			LastLogin: rec.LastLogin, Admin: rec.Admin, Active: rec.Active, Attributes: rec.Attributes}
+		if rec.Password != empty {
+			u.Password, err = HashPassword(rec.Password)
+			if err != nil {
+				return report, err
+			}
+		}
+		entries = append(entries, importEntry{row: row, rec: rec, user: u})
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return report, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	aborted := false
+	changed := []passwordChange{}
+	for _, e := range entries {
+		row, rec, u := e.row, e.rec, e.user
+		if row.Action == "invalid" {
+			report.Invalid++
+			report.Rows = append(report.Rows, row)
+			continue
+		}
+
+		if rec.Email != empty {
+			owner, err := execFindUser(tx, "Email", normalizeEmail(rec.Email))
+			if err != nil && err != ErrUserNotFound {
+				return report, err
+			}
+			if err == nil && owner.Username != rec.Username {
+				row.Action = "invalid"
+				row.Errors = []string{"email already exists"}
+				report.Invalid++
+				report.Rows = append(report.Rows, row)
+				continue
+			}
+		}
+
+		existing, err := execFindUser(tx, "Username", rec.Username)
+		switch {
+		case err == ErrUserNotFound && u.Password == empty:
+			row.Action = "invalid"
+			row.Errors = []string{"password or password_hash is required"}
+			report.Invalid++
+		case err == ErrUserNotFound:
+			_, err = execInsertUser(tx, u)
+			if err != nil {
+				return report, err
+			}
+			row.Action = "created"
+			report.Created++
+		case err != nil:
+			return report, err
+		case opts.OnConflict == ConflictSkip:
+			row.Action = "skipped"
+			report.Skipped++
+		case opts.OnConflict == ConflictOverwrite:
+			// Rows without a password, such as those of an export,
+			// keep the password and the sessions of the user
+			u.ID = existing.ID
+			fields := []string{"user", "email", "lastlogin", "admin", "active"}
+			if u.Password != empty {
+				fields = append(fields, "password")
+			}
+			if len(u.Attributes) != 0 {
+				fields = append(fields, "attributes")
+			}
+			err = execUpdateUser(tx, u, fields, 0)
+			if err != nil {
+				return report, err
+			}
+			if u.Password != empty {
+				// A new password logs the user out, as with PATCH
+				revoked, err := execRevokeCredentials(tx, u.ID)
+				if err != nil {
+					return report, err
+				}
+				changed = append(changed, passwordChange{u.ID, revoked})
+			}
+			row.Action = "updated"
+			report.Updated++
+		default:
+			row.Action = "conflict"
+			row.Errors = []string{"user already exists"}
+			aborted = true
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	if aborted || opts.DryRun {
+		return report, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return report, err
+	}
+	report.Committed = true
+	for _, c := range changed {
+		audit(ctx, AuditPasswordChanged, "user_id", c.userID, "sessions_revoked", c.revoked, "source", "import")
+	}
+	return report, nil
+}
+
+// transferFormat returns the format of an import or export, which is
+// defined by the format query parameter or by the media type mt
+func transferFormat(r *http.Request, mt string) string {
+	format := r.URL.Query().Get("format")
+	if format != empty {
+		return strings.ToLower(format)
+	}
+	if strings.Contains(mt, "csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+// swagger:route GET /v3/users/export users exportUsersV3
+// Export all users as JSON Lines (format=jsonl) or CSV (format=csv).
+// Passwords are not exported.
+//
+// produces:
+//	- application/jsonl
+//	- text/csv
+//
+// responses:
+//	200: UserView
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+
+// ExportHandlerV3 streams all users and requires an administrator
+func ExportHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(rw, r); !ok {
+		return
+	}
+
+	format := transferFormat(r, r.Header.Get("Accept"))
+	switch format {
+	case FormatJSONL:
+		rw.Header().Set("Content-Type", "application/jsonl")
+	case FormatCSV:
+		rw.Header().Set("Content-Type", "text/csv")
+	default:
+		writeError(rw, http.StatusBadRequest, "format must be jsonl or csv")
+		return
+	}
+	rw.Header().Set("Content-Disposition", `attachment; filename="users.`+format+`"`)
+
+	// The status code has been sent once rows are written,
+	// so errors can only be logged
+	err := ExportUsersContext(r.Context(), rw, format)
+	if err != nil {
+		logger(r.Context()).Error("cannot export users", "err", err)
+	}
+}
+
+// swagger:route POST /v3/users/import users importUsersV3
+// Import users from JSON Lines (format=jsonl) or CSV (format=csv).
+// Use dryrun=true to validate without saving and onconflict=fail|skip|overwrite
+// to define what happens with usernames that already exist.
+//
+// consumes:
+//	- application/jsonl
+//	- text/csv
+//
+// responses:
+//	200: ImportReport
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+//	409: ImportReport
+//	413: V3Error
+
+// ImportHandlerV3 imports users and requires an administrator
+func ImportHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(rw, r); !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	opts := ImportOptions{OnConflict: q.Get("onconflict")}
+	if v := q.Get("dryrun"); v != empty {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, "dryrun must be true or false")
+			return
+		}
+		opts.DryRun = dryRun
+	}
+
+	format := transferFormat(r, r.Header.Get("Content-Type"))
+	report, err := ImportUsersContext(r.Context(), r.Body, format, opts)
+	var bad *bodyError
+	if errors.As(err, &bad) {
+		logger(r.Context()).Info("invalid import", "err", err)
+		writeError(rw, bad.status, bad.msg)
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot import users", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot import users")
+		return
+	}
+
+	status := http.StatusOK
+	if !report.Committed && !report.DryRun {
+		status = http.StatusConflict
+	}
+	writeJSON(rw, status, report)
+}
@@ -0,0 +1,181 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImportPasswordHash(t *testing.T) {
+	h := newTestServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"user":"alice","password_hash":"` + string(hash) + `"}` + "\n" +
+		`{"user":"bob","password":"bob-secret"}` + "\n"
+	rw := serve(h, http.MethodPost, "/v3/users/import", body,
+		"Authorization", adminAuth, "Content-Type", "application/jsonl")
+	expectStatus(t, rw, http.StatusOK)
+	var report ImportReport
+	decodeBody(t, rw, &report)
+	if !report.Committed || report.Created != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	for _, u := range []UserPass{{"alice", "alice-secret"}, {"bob", "bob-secret"}} {
+		if _, ok := AuthenticateContext(context.Background(), u); !ok {
+			t.Fatalf("%s cannot log in", u.Username)
+		}
+	}
+}
+
+func TestImportValidatesLikeUsers(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"user":"-alice","password":"alice-secret"}` + "\n" +
+		`{"user":"bob","password":"` + strings.Repeat("b", 73) + `"}` + "\n" +
+		`{"user":"carol","password":"carol-secret","admin":2}` + "\n" +
+		`{"user":"dave","password":"dave-secret","active":1}` + "\n"
+	rw := serve(h, http.MethodPost, "/v3/users/import", body,
+		"Authorization", adminAuth, "Content-Type", "application/jsonl")
+	expectStatus(t, rw, http.StatusOK)
+	var report ImportReport
+	decodeBody(t, rw, &report)
+	if report.Invalid != 3 || report.Created != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	want := []string{"user must be", "password must be at most", "admin must be 0 or 1"}
+	for i, prefix := range want {
+		row := report.Rows[i]
+		if row.Action != "invalid" || len(row.Errors) != 1 || !strings.HasPrefix(row.Errors[0], prefix) {
+			t.Fatalf("row %d = %+v, want an error that starts with %q", i+1, row, prefix)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users/import?format=xml", `<users/>`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusBadRequest)
+
+	rw = serve(h, http.MethodPost, "/v3/users/import", "name,password\nalice,alice-secret\n",
+		"Authorization", adminAuth, "Content-Type", "text/csv")
+	expectStatus(t, rw, http.StatusBadRequest)
+
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TRIGGER broken BEFORE INSERT ON users BEGIN SELECT RAISE(ABORT, 'disk is broken'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = serve(h, http.MethodPost, "/v3/users/import", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth, "Content-Type", "application/jsonl")
+	expectStatus(t, rw, http.StatusInternalServerError)
+	if strings.Contains(rw.Body.String(), "broken") {
+		t.Fatalf("the database error was sent to the client: %s", rw.Body.String())
+	}
+}
+
+func TestImportHashesBeforeTransaction(t *testing.T) {
+	newTestServer(t)
+
+	// The rows are hashed before the transaction begins, so a canceled
+	// import stops there without changing the database
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	body := `{"user":"alice","password":"alice-secret"}` + "\n"
+	_, err := ImportUsersContext(ctx, strings.NewReader(body), FormatJSONL, ImportOptions{})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if FindUserUsername("alice").Username != empty {
+		t.Fatal("a canceled import created a user")
+	}
+}
+
+func TestImportOverwriteRevokesSessions(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	alice := login(t, h, "alice", "alice-secret")
+	if _, _, err := CreatePasswordResetContext(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+
+	rw = serve(h, http.MethodPost, "/v3/users/import?onconflict=overwrite", `{"user":"alice","password":"alice-secret-2"}`,
+		"Authorization", adminAuth, "Content-Type", "application/jsonl")
+	expectStatus(t, rw, http.StatusOK)
+	var report ImportReport
+	decodeBody(t, rw, &report)
+	if report.Updated != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusUnauthorized)
+	if n := countRows("SELECT COUNT(*) FROM password_resets"); n != 0 {
+		t.Fatalf("%v password resets left", n)
+	}
+	if !strings.Contains(logs.String(), `"event":"password_changed"`) {
+		t.Fatalf("logs = %s", logs.String())
+	}
+}
+
+func TestImportStrictJSONL(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"user":"alice","password":"alice-secret","emial":"alice@example.com"}` + "\n"
+	rw := serve(h, http.MethodPost, "/v3/users/import", body,
+		"Authorization", adminAuth, "Content-Type", "application/jsonl")
+	expectStatus(t, rw, http.StatusOK)
+	var report ImportReport
+	decodeBody(t, rw, &report)
+	if report.Invalid != 1 || len(report.Rows) != 1 || !strings.Contains(report.Rows[0].Errors[0], "emial") {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			h := newTestServer(t)
+			rw := serve(h, http.MethodPost, "/v3/users",
+				`{"user":"alice","password":"alice-secret","email":"alice@example.com","attributes":{"department":"Sales"}}`,
+				"Authorization", adminAuth)
+			expectStatus(t, rw, http.StatusCreated)
+
+			rw = serve(h, http.MethodGet, "/v3/users/export?format="+format, empty, "Authorization", adminAuth)
+			expectStatus(t, rw, http.StatusOK)
+			export := rw.Body.String()
+
+			rw = serve(h, http.MethodPost, "/v3/users/import?onconflict=overwrite&format="+format, export,
+				"Authorization", adminAuth)
+			expectStatus(t, rw, http.StatusOK)
+			var report ImportReport
+			decodeBody(t, rw, &report)
+			if !report.Committed || report.Updated != 2 || report.Invalid != 0 {
+				t.Fatalf("report = %+v", report)
+			}
+
+			// The users keep their data and their passwords
+			u := FindUserUsername("alice")
+			if u.Email != "alice@example.com" || string(u.Attributes) != `{"department":"Sales"}` {
+				t.Fatalf("alice = %+v", u)
+			}
+			if _, ok := AuthenticateContext(context.Background(), UserPass{"alice", "alice-secret"}); !ok {
+				t.Fatal("alice cannot log in")
+			}
+		})
+	}
+}
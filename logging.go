@@ -0,0 +1,199 @@
+package shandler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// LogText writes log records as key=value pairs
+	LogText = "text"
+	// LogJSON writes log records as JSON objects
+	LogJSON = "json"
+)
+
+// LOGLEVEL is the minimum level of the records that are written.
+// It can be changed while the server runs.
+var LOGLEVEL = new(slog.LevelVar)
+
+// redacted replaces the values of sensitive attributes
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are the attribute keys whose values are never logged
+var sensitiveKeys = []string{"password", "token", "secret", "authorization", "cookie"}
+
+// isSensitive returns true when key names a secret, such as
+// "password", "password_hash" or "Authorization"
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact is the ReplaceAttr function of the handlers of SetupLogging
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) && a.Value.Kind() != slog.KindGroup {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	if err != nil {
+		return l, errors.New("unknown log level " + s)
+	}
+	return l, nil
+}
+
+// SetupLogging makes a handler that writes format to w the default
+// logger of slog and of the log package. Attributes with sensitive
+// keys are redacted.
+func SetupLogging(w io.Writer, format string, level slog.Level) error {
+	LOGLEVEL.Set(level)
+	opts := &slog.HandlerOptions{Level: LOGLEVEL, ReplaceAttr: redact}
+
+	var h slog.Handler
+	switch format {
+	case LogText, empty:
+		h = slog.NewTextHandler(w, opts)
+	case LogJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return errors.New("unknown log format " + format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// LogValue implements slog.LogValuer, so that passwords are never logged
+func (p User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", p.ID),
+		slog.String("user", p.Username),
+		slog.Int("admin", p.Admin),
+		slog.Int("active", p.Active),
+		slog.Int64("version", p.Version),
+	)
+}
+
+// LogValue implements slog.LogValuer, so that passwords are never logged
+func (p UserPass) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("user", p.Username))
+}
+
+// requestInfo holds the request-scoped values of the logger.
+// The user is only known after authentication, so it is set later
+// by the handlers.
+type requestInfo struct {
+	mutex sync.Mutex
+	id    string
+	user  string
+}
+
+// requestInfoKey is the context key of the requestInfo of a request
+type requestInfoKey struct{}
+
+// newRequestID returns a random ID for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return empty
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequestInfo returns a copy of ctx that carries a requestInfo with id
+func withRequestInfo(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, &requestInfo{id: id})
+}
+
+// RequestID returns the ID of the request of ctx
+func RequestID(ctx context.Context) string {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return empty
+	}
+	return info.id
+}
+
+// setRequestUser records the authenticated user of the request of ctx
+func setRequestUser(ctx context.Context, username string) {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return
+	}
+	info.mutex.Lock()
+	info.user = username
+	info.mutex.Unlock()
+}
+
+// logger returns the default logger with the request ID and the user
+// of the request of ctx
+func logger(ctx context.Context) *slog.Logger {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	l := slog.Default().With("request_id", info.id)
+	if info.user != empty {
+		l = l.With("user", info.user)
+	}
+	return l
+}
+
+// RequestIDHeader is the header that carries the ID of a request
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the size of the request IDs that clients send
+const maxRequestIDLength = 128
+
+// validRequestID returns true when id can be copied to logs and responses
+// as it is: it is not too long and only has letters, digits and -._:
+func validRequestID(id string) bool {
+	if id == empty || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleWare gives every request an ID and a request-scoped logger.
+// The X-Request-ID of the client is used when it is valid, otherwise a new
+// ID is generated. The ID is returned in the X-Request-ID of the response.
+func RequestIDMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		rw.Header().Set(RequestIDHeader, id)
+		ctx := withRequestInfo(r.Context(), id)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,63 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	h := newTestServer(t)
+
+	// A valid ID of the client is kept
+	rw := serve(h, http.MethodGet, "/v3/users/1", empty, RequestIDHeader, "client-42:a.b_c")
+	expectStatus(t, rw, http.StatusUnauthorized)
+	if id := rw.Header().Get(RequestIDHeader); id != "client-42:a.b_c" {
+		t.Fatalf("%s = %q", RequestIDHeader, id)
+	}
+	var body V3Error
+	decodeBody(t, rw, &body)
+	if body.RequestID != "client-42:a.b_c" {
+		t.Fatalf("request_id = %q", body.RequestID)
+	}
+
+	// Other IDs are replaced by new ones, which are unique
+	ids := map[string]bool{}
+	for _, id := range []string{empty, "two words", "<script>", strings.Repeat("a", maxRequestIDLength+1)} {
+		rw = serve(h, http.MethodGet, "/healthz", empty, RequestIDHeader, id)
+		got := rw.Header().Get(RequestIDHeader)
+		if got == empty || got == id || ids[got] {
+			t.Fatalf("%q was replaced by %q", id, got)
+		}
+		ids[got] = true
+	}
+}
+
+func TestRequestIDInLogs(t *testing.T) {
+	h := newTestServer(t)
+	logs := captureLogs(t)
+
+	rw := serve(h, http.MethodPost, "/v3/sessions", `{"user":"admin","password":"wrong-secret"}`,
+		RequestIDHeader, "login-1")
+	expectStatus(t, rw, http.StatusUnauthorized)
+	rw = serve(h, http.MethodPost, "/v3/users", `{"user":"-alice","password":"alice-secret"}`,
+		"Authorization", adminAuth, RequestIDHeader, "create-1")
+	expectStatus(t, rw, http.StatusUnprocessableEntity)
+
+	// Every record of a request has its ID, and the user once known
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	found := map[string]bool{}
+	for _, line := range lines {
+		for _, id := range []string{"login-1", "create-1"} {
+			if strings.Contains(line, `"request_id":"`+id+`"`) {
+				found[id] = true
+			}
+		}
+		if strings.Contains(line, `"request_id":"create-1"`) && !strings.Contains(line, `"user":"admin"`) {
+			t.Fatalf("no user in %s", line)
+		}
+	}
+	if !found["login-1"] || !found["create-1"] {
+		t.Fatalf("request IDs are missing from the logs: %s", logs)
+	}
+}
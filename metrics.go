@@ -0,0 +1,194 @@
+package shandler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every metric that /metrics exposes.
+// Applications that embed shandler can register their own collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shandler_http_requests_total",
+		Help: "Number of HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shandler_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shandler_logins_total",
+		Help: "Number of login attempts by result, either success or failure.",
+	}, []string{"result"})
+
+	uploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "shandler_upload_bytes_total",
+		Help: "Number of bytes of uploaded files.",
+	})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shandler_db_query_duration_seconds",
+		Help:    "Latency of database operations by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shandler_rate_limited_total",
+		Help: "Number of requests rejected by the rate limiter by rule.",
+	}, []string{"rule"})
+
+	panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shandler_panics_total",
+		Help: "Number of panics recovered from handlers by route template.",
+	}, []string{"route"})
+
+	activeSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shandler_active_sessions",
+		Help: "Number of sessions that have not expired.",
+	}, func() float64 {
+		return countRows("SELECT COUNT(*) FROM sessions WHERE Expires > ?", time.Now().Unix())
+	})
+
+	usersTotal = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shandler_users",
+		Help: "Number of users in the database.",
+	}, func() float64 {
+		return countRows("SELECT COUNT(*) FROM users")
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, logins, uploadBytes, queryDuration, rateLimited, panics,
+		activeSessions, usersTotal,
+	)
+}
+
+// countRows returns the result of a COUNT query for a gauge.
+// Errors are reported as NaN, so that a broken database is not
+// mistaken for an empty one.
+func countRows(query string, args ...interface{}) float64 {
+	db, err := openDB()
+	if err != nil {
+		return math.NaN()
+	}
+
+	var n int64
+	err = db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// observeQuery starts timing a database operation.
+// Call the returned function when the operation is complete:
+//
+//	defer observeQuery("find_user")()
+func observeQuery(operation string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// countLogin records the result of a login attempt
+func countLogin(ok bool) {
+	if ok {
+		logins.WithLabelValues("success").Inc()
+		return
+	}
+	logins.WithLabelValues("failure").Inc()
+}
+
+// statusRecorder remembers the status code and the size of the body
+// that a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, which streaming exports need
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the original ResponseWriter
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// routeTemplate returns the path template of the route that matched r.
+// Using the template instead of the path keeps the number of label
+// values bounded.
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	t, err := route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return t
+}
+
+// MetricsMiddleWare counts requests and measures their latency
+func MetricsMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeTemplate(r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// swagger:route GET /metrics metrics NULL
+// Return the metrics of the server in the Prometheus text format
+//
+// responses:
+//	200: OK
+
+// MetricsHandler is for handling /metrics
+var MetricsHandler = promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
@@ -0,0 +1,84 @@
+package shandler
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricValue returns the value of the series of /metrics, such as
+// `shandler_users`, or 0 when /metrics does not have it
+func metricValue(t *testing.T, h http.Handler, series string) float64 {
+	t.Helper()
+	rw := serve(h, http.MethodGet, "/metrics", empty)
+	expectStatus(t, rw, http.StatusOK)
+
+	s := bufio.NewScanner(rw.Body)
+	for s.Scan() {
+		value, ok := strings.CutPrefix(s.Text(), series+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	return 0
+}
+
+func TestRequestMetrics(t *testing.T) {
+	h := newTestServer(t)
+	found := `shandler_http_requests_total{method="GET",route="/v1/username/{id:[0-9]+}",status="200"}`
+	missing := `shandler_http_requests_total{method="GET",route="unmatched",status="404"}`
+	latency := `shandler_http_request_duration_seconds_count{method="GET",route="/v1/username/{id:[0-9]+}"}`
+	before := []float64{metricValue(t, h, found), metricValue(t, h, missing), metricValue(t, h, latency)}
+
+	// The route template is the label, not the path
+	for _, path := range []string{"/v1/username/1", "/v1/username/1", "/v1/nothing"} {
+		serve(h, http.MethodGet, path, empty)
+	}
+	after := []float64{metricValue(t, h, found), metricValue(t, h, missing), metricValue(t, h, latency)}
+	want := []float64{2, 1, 2}
+	for i := range want {
+		if after[i]-before[i] != want[i] {
+			t.Fatalf("metric %d increased by %v, want %v", i, after[i]-before[i], want[i])
+		}
+	}
+	if strings.Contains(serve(h, http.MethodGet, "/metrics", empty).Body.String(), `route="/v1/username/1"`) {
+		t.Fatal("a path was used as a label")
+	}
+}
+
+func TestUserMetrics(t *testing.T) {
+	h := newTestServer(t)
+	success := `shandler_logins_total{result="success"}`
+	failure := `shandler_logins_total{result="failure"}`
+	if n := metricValue(t, h, "shandler_users"); n != 1 {
+		t.Fatalf("shandler_users = %v", n)
+	}
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	successes, failures := metricValue(t, h, success), metricValue(t, h, failure)
+	login(t, h, "alice", "alice-secret")
+	rw = serve(h, http.MethodPost, "/v3/sessions", `{"user":"alice","password":"wrong-secret"}`)
+	expectStatus(t, rw, http.StatusUnauthorized)
+
+	if n := metricValue(t, h, "shandler_users"); n != 2 {
+		t.Fatalf("shandler_users = %v", n)
+	}
+	if n := metricValue(t, h, "shandler_active_sessions"); n != 1 {
+		t.Fatalf("shandler_active_sessions = %v", n)
+	}
+	if metricValue(t, h, success)-successes != 1 || metricValue(t, h, failure)-failures != 1 {
+		t.Fatalf("logins = %v successes, %v failures", metricValue(t, h, success)-successes,
+			metricValue(t, h, failure)-failures)
+	}
+	if metricValue(t, h, `shandler_db_query_duration_seconds_count{operation="add_user"}`) == 0 {
+		t.Fatal("the database operations are not measured")
+	}
+}
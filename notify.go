@@ -0,0 +1,255 @@
+package shandler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// NotifierNone disables the notifications, which is the default
+	NotifierNone = "none"
+	// NotifierLog writes messages to the server log, for development
+	NotifierLog = "log"
+	// NotifierFile appends messages to a file
+	NotifierFile = "file"
+	// NotifierSMTP sends messages by email
+	NotifierSMTP = "smtp"
+)
+
+// Message is a notification for a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// LogNotifier writes messages to the server log. The messages have live
+// tokens, so it is only meant for development.
+type LogNotifier struct{}
+
+// Notify implements Notifier
+func (LogNotifier) Notify(ctx context.Context, m Message) error {
+	logger(ctx).Info("notification", "to", m.To, "subject", m.Subject, "body", m.Body)
+	return nil
+}
+
+// FileNotifier appends messages to a file, separated by blank lines
+type FileNotifier struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileNotifier returns a FileNotifier that writes to path
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+// Notify implements Notifier
+func (n *FileNotifier) Notify(ctx context.Context, m Message) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), m.To, m.Subject, m.Body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SMTPNotifier sends messages through an SMTP server. STARTTLS is used
+// when the server supports it, and the credentials are only sent over
+// TLS or to localhost.
+type SMTPNotifier struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+// NewSMTPNotifier returns an SMTPNotifier for the server at addr, which is
+// host:port. Messages are sent from the address from. Authentication is
+// skipped when username is empty.
+func NewSMTPNotifier(addr, from, username, password string) *SMTPNotifier {
+	return &SMTPNotifier{addr: addr, from: from, username: username, password: password}
+}
+
+// headerValue removes line breaks, so that values cannot add headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", empty, "\n", empty).Replace(s)
+}
+
+// Notify implements Notifier
+func (n *SMTPNotifier) Notify(ctx context.Context, m Message) error {
+	host, _, err := net.SplitHostPort(n.addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if n.username != empty {
+		err = c.Auth(smtp.PlainAuth(empty, n.username, n.password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(n.from)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(m.To)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	body := strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n")
+	_, err = fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		headerValue(n.from), headerValue(m.To), mime.QEncoding.Encode("utf-8", headerValue(m.Subject)),
+		time.Now().Format(time.RFC1123Z), body)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// NewNotifier returns the Notifier that the notifier settings of c define,
+// which is nil when the notifications are disabled
+func NewNotifier(c Config) (Notifier, error) {
+	switch c.Notifier {
+	case NotifierNone:
+		return nil, nil
+	case NotifierLog:
+		return LogNotifier{}, nil
+	case NotifierFile:
+		if c.NotifyFile == empty {
+			return nil, errors.New("notify_file is required with the file notifier")
+		}
+		return NewFileNotifier(c.NotifyFile), nil
+	case NotifierSMTP:
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			return nil, errors.New("smtp_addr must be host:port, such as localhost:25")
+		}
+		if c.SMTPFrom == empty {
+			return nil, errors.New("smtp_from is required with the smtp notifier")
+		}
+		return NewSMTPNotifier(c.SMTPAddr, c.SMTPFrom, c.SMTPUsername, c.SMTPPassword), nil
+	}
+	return nil, errors.New("unknown notifier " + c.Notifier)
+}
+
+// notifierBox lets notifier hold any implementation of Notifier
+type notifierBox struct {
+	Notifier
+}
+
+// notifier is the Notifier of the server, nil when disabled
+var notifier atomic.Pointer[notifierBox]
+
+// notifying counts the messages that are being sent,
+// so that Shutdown can wait for them
+var notifying sync.WaitGroup
+
+// notifyTimeout limits how long a message can take to be delivered
+const notifyTimeout = 30 * time.Second
+
+// SetNotifier replaces the Notifier of the server.
+// A nil Notifier disables the notifications.
+func SetNotifier(n Notifier) {
+	if n == nil {
+		notifier.Store(nil)
+		return
+	}
+	notifier.Store(&notifierBox{n})
+}
+
+// notify sends m in the background, so that the response does not wait
+// for the delivery and its timing does not depend on it
+func notify(ctx context.Context, m Message) {
+	n := notifier.Load()
+	if n == nil {
+		logger(ctx).Warn("notifications are disabled", "subject", m.Subject)
+		return
+	}
+
+	l := logger(ctx)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	notifying.Add(1)
+	go func() {
+		defer notifying.Done()
+		defer cancel()
+		err := n.Notify(ctx, m)
+		if err != nil {
+			l.Error("cannot send notification", "subject", m.Subject, "err", err)
+			return
+		}
+		l.Debug("notification sent", "subject", m.Subject)
+	}()
+}
+
+// waitNotifications waits until the messages in progress are sent
+// or ctx is done
+func waitNotifications(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		notifying.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("notifications have not been sent", "err", ctx.Err())
+	}
+}
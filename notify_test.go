@@ -0,0 +1,132 @@
+package shandler
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a client sent to fakeSMTP
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// fakeSMTP starts an SMTP server on localhost that does not offer
+// STARTTLS, accepts the password of auth and serves one session,
+// which is sent to the returned channel
+func fakeSMTP(t *testing.T, auth string) (string, <-chan smtpSession) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		s := smtpSession{}
+		defer func() { sessions <- s }()
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			s.commands = append(s.commands, line)
+			verb := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch verb {
+			case "EHLO":
+				c.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			case "AUTH":
+				want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+auth))
+				if line == want {
+					c.PrintfLine("235 2.7.0 Authentication successful")
+				} else {
+					c.PrintfLine("535 5.7.8 Authentication credentials invalid")
+				}
+			case "DATA":
+				c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				b, err := c.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				s.data = string(b)
+				c.PrintfLine("250 OK")
+			case "QUIT":
+				c.PrintfLine("221 Bye")
+				return
+			default:
+				c.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	m := Message{To: "alice@example.com", Subject: "Reset your password", Body: "Token:\nabc"}
+	tests := []struct {
+		name     string
+		username string
+		password string
+		auth     bool
+		err      bool
+	}{
+		{"without credentials", empty, empty, false, false},
+		{"with credentials", "mailer", "mailer-secret", true, false},
+		{"with wrong credentials", "mailer", "wrong", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, sessions := fakeSMTP(t, "mailer\x00mailer-secret")
+			n := NewSMTPNotifier(addr, "shandler@example.com", test.username, test.password)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := n.Notify(ctx, m)
+			if (err != nil) != test.err {
+				t.Fatalf("err = %v", err)
+			}
+			s := <-sessions
+			all := strings.Join(s.commands, "\n")
+			if strings.Contains(all, "STARTTLS") {
+				t.Fatalf("STARTTLS was sent to a server without it: %q", s.commands)
+			}
+			if strings.Contains(all, "AUTH") != test.auth {
+				t.Fatalf("commands = %q", s.commands)
+			}
+			if test.err {
+				if s.data != empty {
+					t.Fatal("a message was sent after a failed AUTH")
+				}
+				return
+			}
+
+			r := textproto.NewReader(bufio.NewReader(strings.NewReader(s.data)))
+			header, err := r.ReadMIMEHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Get("To") != m.To || header.Get("From") != "shandler@example.com" {
+				t.Fatalf("header = %v", header)
+			}
+			if !strings.HasSuffix(s.data, "\n\n"+m.Body+"\n") {
+				t.Fatalf("data = %q", s.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package shandler
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BCRYPTCOST defines the cost of the bcrypt hashes of passwords
+var BCRYPTCOST = bcrypt.DefaultCost
+
+// IsPasswordHash reports whether p is a bcrypt hash
+func IsPasswordHash(p string) bool {
+	if !strings.HasPrefix(p, "$2") {
+		return false
+	}
+	_, err := bcrypt.Cost([]byte(p))
+	return err == nil
+}
+
+// HashPassword returns the bcrypt hash of a password.
+// Passwords that look like bcrypt hashes are hashed as well, the
+// password_hash column of imports is the only way to store a hash.
+func HashPassword(p string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(p), BCRYPTCOST)
+	if err != nil {
+		return empty, err
+	}
+	return string(h), nil
+}
+
+// NewPassword returns a random password that is read from crypto/rand
+func NewPassword() (string, error) {
+	return newToken(16)
+}
+
+// CheckPassword reports whether password matches the stored one.
+// Records created before passwords were hashed are compared as plain text,
+// and logins replace them by hashes.
+func CheckPassword(stored, password string) bool {
+	if stored == empty || password == empty {
+		return false
+	}
+
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
@@ -0,0 +1,124 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPasswordHashesHashes(t *testing.T) {
+	h, err := bcrypt.GenerateFromPassword([]byte("alice-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := HashPassword(string(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == string(h) {
+		t.Fatal("a bcrypt hash was stored as it is")
+	}
+	if !CheckPassword(p, string(h)) || CheckPassword(p, "alice-secret") {
+		t.Fatal("the hash was not used as the password")
+	}
+}
+
+func TestPreHashedPasswordsAreHashed(t *testing.T) {
+	h := newTestServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"`+string(hash)+`"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	rw = serve(h, http.MethodPatch, "/v3/users/1", `{"password":"`+string(hash)+`"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+
+	for _, name := range []string{"alice", "admin"} {
+		if _, ok := AuthenticateContext(context.Background(), UserPass{name, "alice-secret"}); ok {
+			t.Fatalf("%s: the password of a bcrypt hash was accepted", name)
+		}
+		if _, ok := AuthenticateContext(context.Background(), UserPass{name, string(hash)}); !ok {
+			t.Fatalf("%s: the hash was not accepted as the password", name)
+		}
+	}
+}
+
+func TestNewPassword(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		p, err := NewPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[p] {
+			t.Fatalf("password %s was returned twice", p)
+		}
+		seen[p] = true
+
+		err = ValidatePassword(User{Username: "alice"}, p)
+		if err != nil {
+			t.Fatalf("password %s is not valid: %v", p, err)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	// Rules of the other fields are not checked
+	u := User{Username: "-"}
+	if err := ValidatePassword(u, "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePassword(u, empty); err == nil {
+		t.Fatal("an empty password is valid")
+	}
+	if err := ValidatePassword(User{Username: "alice"}, "alice"); err == nil {
+		t.Fatal("the username is a valid password")
+	}
+}
+
+func TestLoginHashesPlainTextPasswords(t *testing.T) {
+	h := newTestServer(t)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record of a version that stored passwords in plain text
+	_, err = db.Exec("UPDATE users SET Password = 'admin' WHERE ID = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := serve(h, http.MethodGet, "/v3/users/1", empty, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	u := FindUserUsername("admin")
+	if !IsPasswordHash(u.Password) || !CheckPassword(u.Password, "admin") {
+		t.Fatalf("password = %q, want the hash of admin", u.Password)
+	}
+}
+
+func TestCreateDatabaseAdminPassword(t *testing.T) {
+	SQLFILE = filepath.Join(t.TempDir(), "users.db")
+	password, ok := CreateDatabase()
+	if !ok {
+		t.Fatal("cannot create database")
+	}
+	t.Cleanup(func() { CloseDatabase() })
+
+	if len(password) < 16 {
+		t.Fatalf("password = %q", password)
+	}
+	if _, ok := AuthenticateContext(context.Background(), UserPass{"admin", password}); !ok {
+		t.Fatal("the returned password does not work")
+	}
+	if _, ok := AuthenticateContext(context.Background(), UserPass{"admin", "admin"}); ok {
+		t.Fatal("the admin user has the password admin")
+	}
+}
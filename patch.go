@@ -0,0 +1,388 @@
+package shandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MergePatchType is the media type of RFC 7396 JSON Merge Patch documents
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is the media type of RFC 6902 JSON Patch documents
+	JSONPatchType = "application/json-patch+json"
+)
+
+// PatchOperation defines a single operation of a RFC 6902 JSON Patch document
+// swagger:model PatchOperation
+type PatchOperation struct {
+	// One of add, remove, replace, move, copy and test
+	//
+	// required: true
+	Op string `json:"op"`
+	// JSON Pointer to the target location
+	//
+	// required: true
+	Path string `json:"path"`
+	// JSON Pointer to the source location of move and copy
+	//
+	// required: false
+	From string `json:"from,omitempty"`
+	// The value of add, replace and test
+	//
+	// required: false
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ErrPatchTestFailed is returned when a test operation of a JSON Patch fails
+var ErrPatchTestFailed = errors.New("test operation failed")
+
+// MergePatch applies a RFC 7396 JSON Merge Patch to doc and returns the result
+func MergePatch(doc interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		target[k] = MergePatch(target[k], v)
+	}
+	return target
+}
+
+// JSONPatch applies a RFC 6902 JSON Patch to doc and returns the result.
+// Operations are applied in order and the first failure aborts the patch.
+func JSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	var err error
+	for i, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, deepCopy(op.Value))
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			doc, _, err = pointerRemove(doc, op.Path)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, deepCopy(op.Value))
+			}
+		case "move":
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				err = errors.New("cannot move a value into one of its children")
+				break
+			}
+			var v interface{}
+			doc, v, err = pointerRemove(doc, op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, v)
+			}
+		case "copy":
+			var v interface{}
+			v, err = pointerGet(doc, op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, deepCopy(v))
+			}
+		case "test":
+			var v interface{}
+			v, err = pointerGet(doc, op.Path)
+			if err == nil && !reflect.DeepEqual(v, op.Value) {
+				err = ErrPatchTestFailed
+			}
+		default:
+			err = errors.New("unknown operation " + strconv.Quote(op.Op))
+		}
+
+		if err != nil {
+			if err == ErrPatchTestFailed {
+				return nil, err
+			}
+			return nil, errors.New("operation " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	return doc, nil
+}
+
+// deepCopy returns a copy of a decoded JSON value
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = deepCopy(e)
+		}
+		return s
+	}
+	return v
+}
+
+// splitPointer returns the reference tokens of a RFC 6901 JSON Pointer
+func splitPointer(path string) ([]string, error) {
+	if path == empty {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, errors.New("invalid JSON pointer " + strconv.Quote(path))
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		t = strings.ReplaceAll(t, "~1", "/")
+		tokens[i] = strings.ReplaceAll(t, "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the index of an array element.
+// When allowEnd is true "-" refers to the end of the array.
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index " + strconv.Quote(token))
+	}
+
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if i > max {
+		return 0, errors.New("array index out of range " + strconv.Quote(token))
+	}
+	return i, nil
+}
+
+// pointerGet returns the value that path refers to
+func pointerGet(doc interface{}, path string) (interface{}, error) {
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, errors.New("path not found " + strconv.Quote(path))
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, errors.New("path not found " + strconv.Quote(path))
+		}
+	}
+	return doc, nil
+}
+
+// pointerParent returns the container that holds the value of path
+// together with the last reference token of path
+func pointerParent(doc interface{}, path string) (interface{}, string, error) {
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, empty, err
+	}
+	if len(tokens) == 0 {
+		return nil, empty, nil
+	}
+
+	parentPath := path[:strings.LastIndex(path, "/")]
+	parent, err := pointerGet(doc, parentPath)
+	if err != nil {
+		return nil, empty, err
+	}
+	return parent, tokens[len(tokens)-1], nil
+}
+
+// pointerSet replaces the container at path with v and returns the new document.
+// It is needed because appending to a slice can change its identity.
+func pointerSet(doc interface{}, path string, v interface{}) (interface{}, error) {
+	parent, last, err := pointerParent(doc, path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := parent.(type) {
+	case nil:
+		return v, nil
+	case map[string]interface{}:
+		c[last] = v
+	case []interface{}:
+		i, err := arrayIndex(last, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+	}
+	return doc, nil
+}
+
+// pointerAdd implements the add operation of RFC 6902
+func pointerAdd(doc interface{}, path string, v interface{}) (interface{}, error) {
+	parent, last, err := pointerParent(doc, path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := parent.(type) {
+	case nil:
+		return v, nil
+	case map[string]interface{}:
+		c[last] = v
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(c), true)
+		if err != nil {
+			return nil, err
+		}
+		s := append(c[:i:i], append([]interface{}{v}, c[i:]...)...)
+		return pointerSet(doc, path[:strings.LastIndex(path, "/")], s)
+	}
+	return nil, errors.New("path not found " + strconv.Quote(path))
+}
+
+// pointerRemove implements the remove operation of RFC 6902
+// and returns the value that was removed
+func pointerRemove(doc interface{}, path string) (interface{}, interface{}, error) {
+	parent, last, err := pointerParent(doc, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch c := parent.(type) {
+	case nil:
+		return nil, doc, nil
+	case map[string]interface{}:
+		v, ok := c[last]
+		if !ok {
+			return nil, nil, errors.New("path not found " + strconv.Quote(path))
+		}
+		delete(c, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(c), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := c[i]
+		s := append(c[:i:i], c[i+1:]...)
+		doc, err = pointerSet(doc, path[:strings.LastIndex(path, "/")], s)
+		return doc, v, err
+	}
+	return nil, nil, errors.New("path not found " + strconv.Quote(path))
+}
+
+// userDocument returns the JSON document that patches are applied to.
+// The password is write-only, so it is never part of the document.
+func userDocument(u User) (map[string]interface{}, error) {
+	data, err := json.Marshal(u.View())
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// userPatchFields defines the fields of the document that a patch can change
+var userPatchFields = map[string]bool{"user": true, "password": true, "email": true, "admin": true, "attributes": true}
+
+// clearedFields defines the values of the optional fields that a patch
+// removes, such as the email of {"email":null}
+var clearedFields = map[string]interface{}{"email": empty, "attributes": map[string]interface{}{}}
+
+// PatchUserDocument applies a JSON Merge Patch or a JSON Patch, depending
+// on contentType, to u and returns the fields that have changed.
+// The server fields are returned like the others, for checkWritable to
+// reject them, and changing any other field is an error. Removing the
+// email or the attributes clears them.
+// Documents that are not valid JSON return a *bodyError.
+func PatchUserDocument(u User, contentType string, body []byte) (map[string]interface{}, error) {
+	original, err := userDocument(u)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := userDocument(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	switch contentType {
+	case JSONPatchType:
+		// RFC 6902 ignores the members that an operation does not define,
+		// so unknown fields are allowed here
+		var ops = []PatchOperation{}
+		err = json.Unmarshal(body, &ops)
+		if err != nil {
+			return nil, describeJSONError(err)
+		}
+		result, err = JSONPatch(doc, ops)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var patch interface{}
+		err = decodeStrict(bytes.NewReader(body), &patch)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, errors.New("merge patch must be a JSON object")
+		}
+		result = MergePatch(doc, patch)
+	}
+
+	patched, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("patched document must be a JSON object")
+	}
+
+	changed := map[string]interface{}{}
+	for k := range original {
+		if _, ok := patched[k]; ok {
+			continue
+		}
+		cleared, ok := clearedFields[k]
+		if !ok {
+			return nil, errors.New("field " + strconv.Quote(k) + " cannot be removed")
+		}
+		patched[k] = cleared
+	}
+	for k, v := range patched {
+		if reflect.DeepEqual(original[k], v) {
+			continue
+		}
+		if !userPatchFields[k] && !serverFields[k] {
+			return nil, errors.New("field " + strconv.Quote(k) + " cannot be changed")
+		}
+		changed[k] = v
+	}
+	return changed, nil
+}
@@ -0,0 +1,46 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPatchClearsOptionalFields(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users",
+		`{"user":"alice","password":"alice-secret","email":"alice@example.com","attributes":{"department":"Sales"}}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"email":null,"attributes":null}`,
+		"Authorization", adminAuth, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusOK)
+	var u UserView
+	decodeBody(t, rw, &u)
+	if u.Email != empty || string(u.Attributes) != "{}" {
+		t.Fatalf("user = %+v", u)
+	}
+	if FindUserUsername("alice").Email != empty {
+		t.Fatal("the email was not cleared")
+	}
+
+	// JSON Patch removes them as well
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"email":"alice@example.com"}`,
+		"Authorization", adminAuth, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `[{"op":"remove","path":"/email"}]`,
+		"Authorization", adminAuth, "Content-Type", JSONPatchType)
+	expectStatus(t, rw, http.StatusOK)
+	if FindUserUsername("alice").Email != empty {
+		t.Fatal("the email was not removed")
+	}
+
+	// The other fields are required
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"user":null}`,
+		"Authorization", adminAuth, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusUnprocessableEntity)
+	if !strings.Contains(rw.Body.String(), "cannot be removed") {
+		t.Fatalf("body = %s", rw.Body.String())
+	}
+}
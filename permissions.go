@@ -0,0 +1,289 @@
+package shandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// RoleUser is the role of every user, on their own record
+	RoleUser = "user"
+	// RoleAdmin is the role of administrators, on every record
+	RoleAdmin = "admin"
+)
+
+// Role returns the role of p
+func (p User) Role() string {
+	if p.Admin == 1 {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
+// adminCaller returns the administrator whose credentials are u,
+// for the v1 and v2 handlers that take them in the body
+func adminCaller(ctx context.Context, u UserPass) (User, bool) {
+	if !IsUserAdminContext(ctx, u) {
+		return User{}, false
+	}
+	return FindUserUsernameContext(ctx, u.Username), true
+}
+
+// serverFields are the fields of User that only the server writes
+var serverFields = map[string]bool{"id": true, "email_verified": true, "lastlogin": true, "active": true, "version": true}
+
+// writableFields defines the client-writable fields of User
+// that every role can set. Users change their own password with
+// PUT /v3/users/{id}/password, which checks the current one.
+var writableFields = map[string]map[string]bool{
+	RoleAdmin: {"user": true, "password": true, "email": true, "admin": true, "attributes": true},
+	RoleUser:  {"email": true, "attributes": true},
+}
+
+// checkWritable returns a ValidationError with the fields that a caller
+// with role cannot write, or nil
+func checkWritable(role string, fields []string) error {
+	v := ValidationError{}
+	for _, f := range fields {
+		switch {
+		case serverFields[f]:
+			v = append(v, Violation{Field: f, Rule: "readonly", Message: "is set by the server"})
+		case !writableFields[role][f]:
+			v = append(v, Violation{Field: f, Rule: "forbidden", Message: "cannot be set by a " + role})
+		}
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// writePermissionError writes the fields of err, which checkWritable
+// returned, with 403 Forbidden
+func writePermissionError(rw http.ResponseWriter, r *http.Request, err error) {
+	logger(r.Context()).Warn("fields cannot be written", "err", err)
+	writeJSON(rw, http.StatusForbidden, V3Error{
+		Error:      "fields cannot be written",
+		RequestID:  rw.Header().Get(RequestIDHeader),
+		Violations: ValidationError{}.add(empty, err),
+	})
+}
+
+// UserCreate defines the fields of a new user that clients can set.
+// ID, LastLogin, Active and Version are set by the server.
+// swagger:model UserCreate
+type UserCreate struct {
+	// The Username of the User
+	//
+	// required: true
+	// pattern: ^[a-zA-Z0-9][a-zA-Z0-9._-]{2,31}$
+	Username string `json:"user" validate:"required,username"`
+	// The Password of the User
+	//
+	// required: true
+	// min length: 8
+	// max length: 72
+	Password string `json:"password" validate:"required,min=8,maxbytes=72,nefield=Username"`
+	// The Email address of the User, where password resets are sent
+	//
+	// required: false
+	// max length: 254
+	Email string `json:"email,omitempty" validate:"omitempty,max=254,email"`
+	// Is the User Admin or not
+	//
+	// required: false
+	Admin int `json:"admin" validate:"oneof=0 1"`
+	// The profile Attributes of the User, a JSON object that follows
+	// the attributes schema
+	//
+	// required: false
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// Validate checks the fields of a UserCreate and its attributes
+func (p *UserCreate) Validate() error {
+	v := ValidationError{}.add(empty, validateStruct(p)).add(empty, validateAttributes(p.Attributes))
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// fields returns the fields that p sets
+func (p UserCreate) fields() []string {
+	fields := []string{"user", "password"}
+	if p.Email != empty {
+		fields = append(fields, "email")
+	}
+	if p.Admin != 0 {
+		fields = append(fields, "admin")
+	}
+	if len(p.Attributes) != 0 {
+		fields = append(fields, "attributes")
+	}
+	return fields
+}
+
+// serverFieldValues captures the server fields that a body sets, so that
+// checkWritable reports them as readonly instead of the decoder rejecting
+// them as unknown
+type serverFieldValues struct {
+	ID            json.RawMessage `json:"id"`
+	EmailVerified json.RawMessage `json:"email_verified"`
+	LastLogin     json.RawMessage `json:"lastlogin"`
+	Active        json.RawMessage `json:"active"`
+	Version       json.RawMessage `json:"version"`
+}
+
+// fields returns the server fields that p sets
+func (p serverFieldValues) fields() []string {
+	fields := []string{}
+	server := []struct {
+		name  string
+		value json.RawMessage
+	}{{"id", p.ID}, {"email_verified", p.EmailVerified}, {"lastlogin", p.LastLogin}, {"active", p.Active}, {"version", p.Version}}
+	for _, f := range server {
+		if f.value != nil {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// userCreateBody is the body that creates a user in v3 and in batches
+type userCreateBody struct {
+	UserCreate
+	serverFieldValues
+}
+
+// fields returns the fields that p sets, server fields included
+func (p userCreateBody) fields() []string {
+	return append(p.UserCreate.fields(), p.serverFieldValues.fields()...)
+}
+
+// inputBody is an element of the v1 bodies that create and update users
+type inputBody struct {
+	Input
+	serverFieldValues
+}
+
+// v2InputBody is the body of POST /v2/add. Its load is a userCreateBody,
+// which replaces the UserCreate of V2Input.
+type v2InputBody struct {
+	V2Input
+	U userCreateBody `json:"load"`
+}
+
+// NewUser returns the User that p creates
+func (p UserCreate) NewUser() User {
+	return User{ID: -1, Username: p.Username, Password: p.Password, Email: p.Email,
+		LastLogin: time.Now().Unix(), Admin: p.Admin, Attributes: p.Attributes}
+}
+
+// UserUpdate defines the fields of a user that clients can change.
+// The fields that are not set keep their values.
+// swagger:model UserUpdate
+type UserUpdate struct {
+	// The new Username of the User
+	//
+	// required: false
+	Username *string `json:"user,omitempty"`
+	// The new Password of the User
+	//
+	// required: false
+	Password *string `json:"password,omitempty"`
+	// The new Email address of the User, or an empty string to remove it
+	//
+	// required: false
+	Email *string `json:"email,omitempty"`
+	// Is the User Admin or not
+	//
+	// required: false
+	Admin *int `json:"admin,omitempty"`
+	// The new profile Attributes of the User
+	//
+	// required: false
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// fields returns the sorted names of the fields that p sets
+func (p UserUpdate) fields() []string {
+	fields := []string{}
+	if p.Admin != nil {
+		fields = append(fields, "admin")
+	}
+	if p.Attributes != nil {
+		fields = append(fields, "attributes")
+	}
+	if p.Email != nil {
+		fields = append(fields, "email")
+	}
+	if p.Password != nil {
+		fields = append(fields, "password")
+	}
+	if p.Username != nil {
+		fields = append(fields, "user")
+	}
+	return fields
+}
+
+// newUserUpdate returns the UserUpdate of the changes that
+// PatchUserDocument returned. The server fields among them
+// must have been rejected by checkWritable.
+func newUserUpdate(changed map[string]interface{}) (UserUpdate, error) {
+	u := UserUpdate{}
+	for k, v := range changed {
+		switch k {
+		case "user":
+			username, ok := v.(string)
+			if !ok || username == empty {
+				return u, errors.New("user must be a non-empty string")
+			}
+			u.Username = &username
+		case "password":
+			password, ok := v.(string)
+			if !ok || password == empty {
+				return u, errors.New("password must be a non-empty string")
+			}
+			u.Password = &password
+		case "email":
+			email, ok := v.(string)
+			if !ok {
+				return u, errors.New("email must be a string")
+			}
+			u.Email = &email
+		case "admin":
+			admin, ok := v.(float64)
+			if !ok || (admin != 0 && admin != 1) {
+				return u, errors.New("admin must be 0 or 1")
+			}
+			n := int(admin)
+			u.Admin = &n
+		case "attributes":
+			attributes, ok := v.(map[string]interface{})
+			if !ok {
+				return u, errors.New("attributes must be a JSON object")
+			}
+			data, err := json.Marshal(attributes)
+			if err != nil {
+				return u, errors.New("attributes must be a JSON object")
+			}
+			u.Attributes = data
+		}
+	}
+	return u, nil
+}
+
+// changedFields returns the sorted names of the fields in changed
+func changedFields(changed map[string]interface{}) []string {
+	fields := make([]string, 0, len(changed))
+	for k := range changed {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,121 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCreateServerFields(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","id":7,"active":1}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusForbidden)
+	var e V3Error
+	decodeBody(t, rw, &e)
+	if len(e.Violations) != 2 || e.Violations[0] != (Violation{Field: "id", Rule: "readonly", Message: "is set by the server"}) ||
+		e.Violations[1].Field != "active" {
+		t.Fatalf("violations = %+v", e.Violations)
+	}
+	if FindUserUsername("alice").Username != empty {
+		t.Fatal("a user with server fields was created")
+	}
+
+	rw = serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","role":"admin"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusBadRequest)
+}
+
+func TestBatchCreateServerFields(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"mode":"independent","operations":[
+		{"op":"create","user":{"user":"alice","password":"alice-secret","version":3}},
+		{"op":"create","user":{"user":"bob","password":"bob-secret","role":"admin"}},
+		{"op":"create","user":{"user":"carol","password":"carol-secret"}}
+	]}`
+	rw := serve(h, http.MethodPost, "/v3/users/batch", body, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusOK)
+	var res BatchResponse
+	decodeBody(t, rw, &res)
+	want := []struct {
+		status int
+		msg    string
+	}{{http.StatusForbidden, "version: is set by the server"}, {http.StatusBadRequest, `unknown field "role"`}, {http.StatusCreated, empty}}
+	for i, w := range want {
+		if res.Results[i].Status != w.status || !strings.Contains(res.Results[i].Error, w.msg) {
+			t.Fatalf("result %d = %+v, want status %d and %q", i, res.Results[i], w.status, w.msg)
+		}
+	}
+	if FindUserUsername("alice").Username != empty || FindUserUsername("bob").Username != empty {
+		t.Fatal("a rejected user was created")
+	}
+}
+
+func TestUserRoleWritableFields(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	alice := login(t, h, "alice", "alice-secret")
+
+	forbidden := []struct {
+		body, field, rule string
+	}{
+		{`{"admin":1}`, "admin", "forbidden"},
+		{`{"user":"mallory"}`, "user", "forbidden"},
+		{`{"password":"alice-secret-2"}`, "password", "forbidden"},
+		{`{"active":0}`, "active", "readonly"},
+	}
+	for _, f := range forbidden {
+		rw = serve(h, http.MethodPatch, "/v3/users/2", f.body, "Authorization", alice, "Content-Type", MergePatchType)
+		expectStatus(t, rw, http.StatusForbidden)
+		var e V3Error
+		decodeBody(t, rw, &e)
+		if len(e.Violations) != 1 || e.Violations[0].Field != f.field || e.Violations[0].Rule != f.rule {
+			t.Fatalf("%s: violations = %+v", f.body, e.Violations)
+		}
+	}
+	if u := FindUserUsername("alice"); u.Admin != 0 || u.Active != 1 {
+		t.Fatalf("alice = %+v", u.View())
+	}
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"email":"alice@example.com","attributes":{"phone":"555-0100"}}`,
+		"Authorization", alice, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusOK)
+
+	// Users only change their own record
+	rw = serve(h, http.MethodPatch, "/v3/users/1", `{"email":"admin@example.com"}`,
+		"Authorization", alice, "Content-Type", MergePatchType)
+	expectStatus(t, rw, http.StatusForbidden)
+}
+
+func TestServerFieldsInEveryVersion(t *testing.T) {
+	h := newTestServer(t)
+
+	requests := []struct {
+		method, path, body, field string
+	}{
+		{http.MethodPost, "/v1/add", `[{"user":"admin","password":"admin"},{"user":"bob","password":"bob-secret","active":1}]`, "[1].active"},
+		{http.MethodPut, "/v1/update", `[{"user":"admin","password":"admin"},{"user":"admin","password":"admin-secret","version":9}]`, "[1].version"},
+		{http.MethodPost, "/v2/add", `{"username":"admin","password":"admin","load":{"user":"bob","password":"bob-secret","lastlogin":5}}`, "load.lastlogin"},
+		{http.MethodPost, "/v3/users", `{"user":"bob","password":"bob-secret","email_verified":1}`, "email_verified"},
+		{http.MethodPatch, "/v3/users/1", `{"id":7}`, "id"},
+	}
+	for _, r := range requests {
+		rw := serve(h, r.method, r.path, r.body, "Authorization", adminAuth)
+		expectStatus(t, rw, http.StatusForbidden)
+		var e V3Error
+		decodeBody(t, rw, &e)
+		if len(e.Violations) != 1 || e.Violations[0] != (Violation{Field: r.field, Rule: "readonly", Message: "is set by the server"}) {
+			t.Fatalf("%s %s: violations = %+v", r.method, r.path, e.Violations)
+		}
+	}
+
+	rw := serve(h, http.MethodPost, "/v3/users/batch", `{"operations":[{"op":"update","id":1,"user":{"version":9}}]}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusForbidden)
+	if FindUserUsername("bob").Username != empty || FindUserID(1).Version == 9 {
+		t.Fatal("a server field was written")
+	}
+}
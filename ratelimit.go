@@ -0,0 +1,249 @@
+package shandler
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RateLimitByIP gives every client IP address its own bucket
+	RateLimitByIP = "ip"
+	// RateLimitByUser gives every user with a session token its own
+	// bucket, and every IP address of the other requests
+	RateLimitByUser = "user"
+)
+
+// RateLimitRule defines the limit of the requests that match Route and Method.
+// Route is a route template, such as /v3/users/{id:[0-9]+}, or a path
+// prefix that ends with *. A bucket holds Burst requests and refills
+// at a rate of Requests every Per.
+type RateLimitRule struct {
+	Route    string   `yaml:"route" toml:"route"`
+	Method   string   `yaml:"method,omitempty" toml:"method,omitempty"`
+	By       string   `yaml:"by,omitempty" toml:"by,omitempty"`
+	Requests int      `yaml:"requests" toml:"requests"`
+	Per      Duration `yaml:"per" toml:"per"`
+	Burst    int      `yaml:"burst,omitempty" toml:"burst,omitempty"`
+}
+
+// validate returns the problems of r
+func (r RateLimitRule) validate() error {
+	if r.Route == empty {
+		return errors.New("route is required")
+	}
+	if r.By != empty && r.By != RateLimitByIP && r.By != RateLimitByUser {
+		return errors.New("by must be ip or user")
+	}
+	if r.Requests <= 0 {
+		return errors.New("requests must be positive")
+	}
+	if r.Per.Duration <= 0 {
+		return errors.New("per must be positive")
+	}
+	if r.Burst < 0 {
+		return errors.New("burst cannot be negative")
+	}
+	return nil
+}
+
+// matches returns true when the rule applies to a request
+func (r RateLimitRule) matches(method, route, path string) bool {
+	return matchRoute(r.Route, r.Method, method, route, path)
+}
+
+// burst returns the capacity of the buckets of the rule
+func (r RateLimitRule) burst() int {
+	if r.Burst == 0 {
+		return r.Requests
+	}
+	return r.Burst
+}
+
+// RateLimitResult is the state of a bucket after a request
+type RateLimitResult struct {
+	// Allowed is false when the request must be rejected
+	Allowed bool
+	// Limit is the capacity of the bucket
+	Limit int
+	// Remaining is the number of requests that are allowed now
+	Remaining int
+	// RetryAfter is how long until the next request is allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore holds the token buckets of the rate limiter.
+// Implementations can share the buckets between instances of the server.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, which holds burst
+	// tokens and gains rate tokens every second
+	Take(key string, rate float64, burst int) RateLimitResult
+}
+
+// bucket is a token bucket of MemoryRateLimitStore
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// refill adds the tokens that have accumulated since the last request
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// MemoryRateLimitStore keeps the token buckets in memory,
+// so every instance of the server has its own limits
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}, swept: time.Now()}
+}
+
+// sweepInterval is how often full buckets are removed from memory
+const sweepInterval = time.Minute
+
+// Take implements RateLimitStore
+func (m *MemoryRateLimitStore) Take(key string, rate float64, burst int) RateLimitResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.swept) > sweepInterval {
+		// A full bucket is the same as a missing one
+		for k, b := range m.buckets {
+			b.refill(now)
+			if b.tokens >= float64(b.burst) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	b.rate = rate
+	b.burst = burst
+	b.refill(now)
+
+	res := RateLimitResult{Limit: burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	return res
+}
+
+// RateLimiter applies the first matching RateLimitRule to every request
+type RateLimiter struct {
+	rules []RateLimitRule
+	store RateLimitStore
+}
+
+// NewRateLimiter returns a RateLimiter that keeps its buckets in store
+func NewRateLimiter(rules []RateLimitRule, store RateLimitStore) *RateLimiter {
+	return &RateLimiter{rules: rules, store: store}
+}
+
+// rateLimitStore keeps the buckets of the server, so that they
+// survive the configuration reloads
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// rateLimiter is the RateLimiter of RateLimitMiddleWare, nil when disabled
+var rateLimiter atomic.Pointer[RateLimiter]
+
+func init() {
+	rateLimiter.Store(NewRateLimiter(DefaultConfig().RateLimits, rateLimitStore))
+}
+
+// SetRateLimiter replaces the RateLimiter of RateLimitMiddleWare.
+// A nil RateLimiter disables rate limiting.
+func SetRateLimiter(l *RateLimiter) {
+	rateLimiter.Store(l)
+}
+
+// clientIP returns the IP address of the client of r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKey returns the bucket key of r for rule.
+// Users are identified by their session token only, since checking
+// a password for every request would be too expensive.
+func rateLimitKey(r *http.Request, rule RateLimitRule) string {
+	prefix := rule.Method + " " + rule.Route + " "
+	if rule.By == RateLimitByUser {
+		if token, ok := bearerToken(r); ok {
+			if s, ok := FindSessionContext(r.Context(), token); ok {
+				return prefix + "user:" + strconv.Itoa(s.UserID)
+			}
+		}
+	}
+	return prefix + "ip:" + clientIP(r)
+}
+
+// seconds rounds d up to whole seconds for the RateLimit-* headers
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// RateLimitMiddleWare rejects the requests that exceed their rate limit
+// with 429 Too Many Requests and a Retry-After header. The RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers are set on every
+// response that a rule applies to.
+func RateLimitMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		l := rateLimiter.Load()
+		if l == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		route := routeTemplate(r)
+		for _, rule := range l.rules {
+			if !rule.matches(r.Method, route, r.URL.Path) {
+				continue
+			}
+
+			rate := float64(rule.Requests) / rule.Per.Seconds()
+			res := l.store.Take(rateLimitKey(r, rule), rate, rule.burst())
+			rw.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			rw.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			rw.Header().Set("RateLimit-Reset", seconds(res.Reset))
+			if !res.Allowed {
+				rateLimited.WithLabelValues(rule.Route).Inc()
+				logger(r.Context()).Warn("rate limit exceeded", "rule", rule.Route, "ip", clientIP(r))
+				rw.Header().Set("Retry-After", seconds(res.RetryAfter))
+				writeError(rw, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			break
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
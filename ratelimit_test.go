@@ -0,0 +1,126 @@
+package shandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// limitRequests replaces the rate limits with rules until t ends
+func limitRequests(t *testing.T, rules ...RateLimitRule) {
+	t.Helper()
+	old := rateLimiter.Load()
+	SetRateLimiter(NewRateLimiter(rules, NewMemoryRateLimitStore()))
+	t.Cleanup(func() { SetRateLimiter(old) })
+}
+
+// serveFrom is like serve for a client with the IP address ip
+func serveFrom(h http.Handler, ip, method, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = ip + ":40000"
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	h := newTestServer(t)
+	limitRequests(t,
+		RateLimitRule{Route: "/v1/time", Requests: 2, Per: Duration{time.Hour}},
+		RateLimitRule{Route: "/v1/*", Requests: 1, Per: Duration{time.Hour}},
+	)
+
+	for i, remaining := range []string{"1", "0"} {
+		rw := serveFrom(h, "192.0.2.1", http.MethodGet, "/v1/time")
+		expectStatus(t, rw, http.StatusOK)
+		if rw.Header().Get("RateLimit-Limit") != "2" || rw.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d: headers = %v", i+1, rw.Header())
+		}
+	}
+	rw := serveFrom(h, "192.0.2.1", http.MethodGet, "/v1/time")
+	expectStatus(t, rw, http.StatusTooManyRequests)
+	retry, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 1800 {
+		t.Fatalf("Retry-After = %q", rw.Header().Get("Retry-After"))
+	}
+	var body V3Error
+	decodeBody(t, rw, &body)
+	if body.Error != "rate limit exceeded" {
+		t.Fatalf("body = %+v", body)
+	}
+
+	// Other clients have their own buckets
+	rw = serveFrom(h, "192.0.2.2", http.MethodGet, "/v1/time")
+	expectStatus(t, rw, http.StatusOK)
+
+	// Only the first matching rule applies, and other routes have no limit
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v1/username/1")
+	expectStatus(t, rw, http.StatusOK)
+	if rw.Header().Get("RateLimit-Limit") != "1" {
+		t.Fatalf("headers = %v", rw.Header())
+	}
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/healthz")
+	expectStatus(t, rw, http.StatusOK)
+	if rw.Header().Get("RateLimit-Limit") != empty {
+		t.Fatalf("headers = %v", rw.Header())
+	}
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	admin := login(t, h, "admin", "admin")
+	alice := login(t, h, "alice", "alice-secret")
+	limitRequests(t, RateLimitRule{Route: "/v3/users/{id:[0-9]+}", Method: http.MethodGet,
+		By: RateLimitByUser, Requests: 1, Per: Duration{time.Hour}})
+
+	// Users behind the same IP address have their own buckets
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v3/users/1", "Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v3/users/2", "Authorization", alice)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v3/users/2", "Authorization", alice)
+	expectStatus(t, rw, http.StatusTooManyRequests)
+
+	// Requests without a session are limited by IP address
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v3/users/1")
+	expectStatus(t, rw, http.StatusUnauthorized)
+	rw = serveFrom(h, "192.0.2.1", http.MethodGet, "/v3/users/1", "Authorization", "Bearer not-a-token")
+	expectStatus(t, rw, http.StatusTooManyRequests)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	m := NewMemoryRateLimitStore()
+	if res := m.Take("key", 100, 1); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("first = %+v", res)
+	}
+	res := m.Take("key", 100, 1)
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 10*time.Millisecond {
+		t.Fatalf("second = %+v", res)
+	}
+	if !m.Take("other", 100, 1).Allowed {
+		t.Fatal("the buckets of other keys are shared")
+	}
+
+	// The bucket refills at the rate
+	time.Sleep(res.RetryAfter + 5*time.Millisecond)
+	if res = m.Take("key", 100, 1); !res.Allowed {
+		t.Fatalf("after the refill = %+v", res)
+	}
+}
+
+func TestRateLimitRulesValidate(t *testing.T) {
+	c := DefaultConfig()
+	c.RateLimits = []RateLimitRule{{Route: "/v1/time", By: "session", Requests: 0, Per: Duration{time.Second}}}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "rate_limits") {
+		t.Fatalf("err = %v, want an error about rate_limits", err)
+	}
+}
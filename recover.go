@@ -0,0 +1,41 @@
+package shandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// RecoverMiddleWare turns a panic of a handler into a 500 response.
+// The panic and its stack are logged, recorded on the span of the
+// request and counted in shandler_panics_total.
+func RecoverMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: rw}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// ErrAbortHandler is how handlers drop a connection on purpose
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			route := routeTemplate(r)
+			panics.WithLabelValues(route).Inc()
+			traceError(r.Context(), errors.New("panic: "+fmt.Sprint(p)))
+			logger(r.Context()).Error("panic", "route", route, "panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()))
+
+			// The response has started, so the only way to tell the
+			// client that it is incomplete is to drop the connection
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rw, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,125 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// middlewareRouter returns a router with the middlewares of NewRouter
+// and handlers for the paths of routes
+func middlewareRouter(routes map[string]http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	for path, h := range routes {
+		r.HandleFunc(path, h)
+	}
+	r.Use(RequestIDMiddleWare, TracingMiddleWare, MetricsMiddleWare, MiddleWare,
+		RecoverMiddleWare, CORSMiddleWare, RateLimitMiddleWare, BodyLimitMiddleWare,
+		TimeoutMiddleWare)
+	return r
+}
+
+func TestRecoverPanic(t *testing.T) {
+	h := newTestServer(t)
+	series := `shandler_panics_total{route="/panic"}`
+	before := metricValue(t, h, series)
+	logs := captureLogs(t)
+	r := middlewareRouter(map[string]http.HandlerFunc{
+		"/panic": func(rw http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		},
+	})
+
+	rw := serve(r, http.MethodGet, "/panic", empty, RequestIDHeader, "panic-1")
+	expectStatus(t, rw, http.StatusInternalServerError)
+	var body V3Error
+	decodeBody(t, rw, &body)
+	if body.Error != "internal server error" || body.RequestID != "panic-1" {
+		t.Fatalf("body = %+v", body)
+	}
+	if !strings.Contains(logs.String(), `"panic":"boom"`) || !strings.Contains(logs.String(), "recover_test.go") {
+		t.Fatalf("the panic and its stack were not logged: %s", logs)
+	}
+	if n := metricValue(t, h, series) - before; n != 1 {
+		t.Fatalf("%s increased by %v", series, n)
+	}
+
+	// The server keeps serving
+	rw = serve(h, http.MethodGet, "/healthz", empty)
+	expectStatus(t, rw, http.StatusOK)
+}
+
+func TestRecoverPanicAfterWrite(t *testing.T) {
+	newTestServer(t)
+	captureLogs(t)
+	r := middlewareRouter(map[string]http.HandlerFunc{
+		"/partial": func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte("half"))
+			panic("boom")
+		},
+	})
+	// Timeouts buffer the response, which is not started then
+	old := handlerTimeouts.Load()
+	SetTimeouts(nil)
+	t.Cleanup(func() { SetTimeouts(old) })
+
+	// The connection is dropped, so that the client sees an incomplete response
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("panic = %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	serve(r, http.MethodGet, "/partial", empty)
+	t.Fatal("the panic was not propagated")
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	newTestServer(t)
+	old := handlerTimeouts.Load()
+	SetTimeouts(NewTimeouts(50*time.Millisecond, []RouteTimeout{{Route: "/stream"}}))
+	t.Cleanup(func() { SetTimeouts(old) })
+
+	canceled := make(chan error, 1)
+	r := middlewareRouter(map[string]http.HandlerFunc{
+		"/slow": func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			canceled <- r.Context().Err()
+		},
+		"/stream": func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			rw.Write([]byte("done"))
+		},
+	})
+
+	rw := serve(r, http.MethodGet, "/slow", empty, RequestIDHeader, "slow-1")
+	expectStatus(t, rw, http.StatusServiceUnavailable)
+	if rw.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Content-Type = %q", rw.Header().Get("Content-Type"))
+	}
+	var body V3Error
+	decodeBody(t, rw, &body)
+	if body.Error != "request timed out" || body.RequestID != "slow-1" {
+		t.Fatalf("body = %+v", body)
+	}
+	// The handler sees the timeout in its context
+	select {
+	case err := <-canceled:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context of the handler was not canceled")
+	}
+
+	// A zero timeout disables it
+	rw = serve(r, http.MethodGet, "/stream", empty)
+	expectStatus(t, rw, http.StatusOK)
+	if rw.Body.String() != "done" {
+		t.Fatalf("body = %q", rw.Body.String())
+	}
+}
@@ -0,0 +1,378 @@
+package shandler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESETTTL defines how long a password reset token remains valid
+var RESETTTL = time.Hour
+
+// RESETURL is the link of the password reset messages, where {token} is
+// replaced by the token. The token is sent on its own when it is empty.
+var RESETURL = empty
+
+// RESETREQUESTS is how many password resets an account can request
+// every RESETPER, so that users cannot be flooded with messages
+var RESETREQUESTS = 3
+
+// RESETPER is the period of RESETREQUESTS
+var RESETPER = time.Hour
+
+// ErrInvalidResetToken is returned for password reset tokens that do not
+// exist, have expired or have already been used
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// PasswordResetRequest defines the body of POST /v3/password-resets.
+// Exactly one of User and Email identifies the account.
+// swagger:model PasswordResetRequest
+type PasswordResetRequest struct {
+	// The Username of the User
+	//
+	// required: false
+	Username string `json:"user,omitempty" validate:"required_without=Email"`
+	// The Email address of the User
+	//
+	// required: false
+	Email string `json:"email,omitempty" validate:"omitempty,email"`
+}
+
+// Validate checks the fields of a PasswordResetRequest
+func (p *PasswordResetRequest) Validate() error {
+	v := ValidationError{}.add(empty, validateStruct(p))
+	if p.Username != empty && p.Email != empty {
+		v = append(v, Violation{Field: "email", Rule: "excluded_with", Message: "cannot be set with user"})
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// PasswordResetConfirm defines the body of POST /v3/password-resets/confirm
+// swagger:model PasswordResetConfirm
+type PasswordResetConfirm struct {
+	// The token of the password reset message
+	//
+	// required: true
+	Token string `json:"token" validate:"required"`
+	// The new Password of the User
+	//
+	// required: true
+	// min length: 8
+	// max length: 72
+	NewPassword string `json:"new_password" validate:"required,min=8,maxbytes=72"`
+}
+
+// Validate checks the fields of a PasswordResetConfirm
+func (p *PasswordResetConfirm) Validate() error {
+	return validateStruct(p)
+}
+
+// CreatePasswordResetContext creates a password reset token for a user and
+// returns it with its expiration time. The earlier tokens of the user stop
+// working, so only the latest message can be used.
+func CreatePasswordResetContext(ctx context.Context, userID int) (string, int64, error) {
+	ctx, end := startOperation(ctx, "CreatePasswordReset", "create_password_reset")
+	defer end()
+
+	token, err := newToken(32)
+	if err != nil {
+		return empty, 0, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return empty, 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return empty, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM password_resets WHERE UserID = ?", userID)
+	if err != nil {
+		return empty, 0, err
+	}
+
+	now := time.Now()
+	expires := now.Add(RESETTTL).Unix()
+	_, err = tx.ExecContext(ctx, "INSERT INTO password_resets(UserID, Token, Created, Expires) values(?,?,?,?)",
+		userID, hashToken(token), now.Unix(), expires)
+	if err != nil {
+		return empty, 0, err
+	}
+	return token, expires, tx.Commit()
+}
+
+// FindPasswordResetContext returns the ID of the user of a password reset
+// token, or ErrInvalidResetToken when the token cannot be used
+func FindPasswordResetContext(ctx context.Context, token string) (int, error) {
+	ctx, end := startOperation(ctx, "FindPasswordReset", "find_password_reset")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = db.QueryRowContext(ctx, "SELECT UserID FROM password_resets WHERE Token = ? AND Expires >= ?",
+		hashToken(token), time.Now().Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, err
+}
+
+// ResetPasswordContext consumes a password reset token of t and sets the
+// password of t, which is in plain text, in a single transaction, so that
+// the token keeps working when the password cannot be stored. It returns
+// ErrInvalidResetToken when the token is unknown, expired or used.
+func ResetPasswordContext(ctx context.Context, t User, token string) error {
+	ctx, end := startOperation(ctx, "ResetPassword", "update_user")
+	defer end()
+
+	// Hashing is slow, so it happens before the transaction
+	password, err := HashPassword(t.Password)
+	if err != nil {
+		return err
+	}
+	t.Password = password
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE UserID = ? AND Token = ? AND Expires >= ?",
+		t.ID, hashToken(token), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	affect, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affect != 1 {
+		return ErrInvalidResetToken
+	}
+
+	err = execUpdateUser(tx, t, []string{"password"}, 0)
+	if err != nil {
+		traceError(ctx, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeletePasswordResets deletes the password reset tokens of a user
+func DeletePasswordResets(userID int) error {
+	return DeletePasswordResetsContext(context.Background(), userID)
+}
+
+// DeletePasswordResetsContext is like DeletePasswordResets, with ctx for tracing and cancellation
+func DeletePasswordResetsContext(ctx context.Context, userID int) error {
+	ctx, end := startOperation(ctx, "DeletePasswordResets", "delete_password_reset")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM password_resets WHERE UserID = ?", userID)
+	return err
+}
+
+// DeleteExpiredPasswordResets is for deleting the password reset tokens
+// that have expired
+func DeleteExpiredPasswordResets() bool {
+	defer observeQuery("delete_expired_password_resets")()
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return false
+	}
+
+	_, err = db.Exec("DELETE FROM password_resets WHERE Expires < ?", time.Now().Unix())
+	if err != nil {
+		slog.Error("cannot delete expired password resets", "err", err)
+		return false
+	}
+	return true
+}
+
+// resetMessage returns the message that delivers token to u
+func resetMessage(u User, token string, expires int64) Message {
+	link := token
+	if RESETURL != empty {
+		link = strings.ReplaceAll(RESETURL, "{token}", token)
+	}
+	return Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: "Hello " + u.Username + ",\n\n" +
+			"Use the following to choose a new password:\n\n" + link + "\n\n" +
+			"It expires at " + time.Unix(expires, 0).UTC().Format(time.RFC1123) + ".\n" +
+			"If you did not ask for a new password, you can ignore this message.",
+	}
+}
+
+// swagger:route POST /v3/password-resets sessions requestPasswordResetV3
+// Send a password reset token to the verified email address of a user.
+// The response is the same whether the user exists or not.
+//
+// responses:
+//	202: OK
+//	400: V3Error
+//	415: V3Error
+//	422: V3Error
+
+// RequestPasswordResetHandlerV3 sends a password reset message to a user
+func RequestPasswordResetHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	var in = PasswordResetRequest{}
+	err := decodeJSON(r, &in)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	// Clients cannot tell the accounts that exist from the others,
+	// so the response is always 202 Accepted
+	sendPasswordReset(r.Context(), in)
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset creates a password reset token for the account of in,
+// when it exists and has a verified email address, and sends it
+func sendPasswordReset(ctx context.Context, in PasswordResetRequest) {
+	var t User
+	if in.Email != empty {
+		t = FindUserEmailContext(ctx, in.Email)
+	} else {
+		t = FindUserUsernameContext(ctx, in.Username)
+	}
+	if t.Username == empty || t.Email == empty {
+		logger(ctx).Info("password reset for unknown account")
+		return
+	}
+	if t.EmailVerified != 1 {
+		logger(ctx).Info("password reset for unverified email address", "id", t.ID)
+		return
+	}
+
+	res := rateLimitStore.Take("password_reset user:"+strconv.Itoa(t.ID),
+		float64(RESETREQUESTS)/RESETPER.Seconds(), RESETREQUESTS)
+	if !res.Allowed {
+		rateLimited.WithLabelValues("password_reset").Inc()
+		audit(ctx, AuditPasswordResetLimited, "user_id", t.ID)
+		return
+	}
+
+	token, expires, err := CreatePasswordResetContext(ctx, t.ID)
+	if err != nil {
+		logger(ctx).Error("cannot create password reset", "id", t.ID, "err", err)
+		return
+	}
+	audit(ctx, AuditPasswordResetRequested, "user_id", t.ID)
+	notify(ctx, resetMessage(t, token, expires))
+}
+
+// swagger:route POST /v3/password-resets/confirm sessions confirmPasswordResetV3
+// Choose a new password with a password reset token.
+// Every session of the user is deleted.
+//
+// responses:
+//	204: OK
+//	400: V3Error
+//	415: V3Error
+//	422: V3Error
+
+// ConfirmPasswordResetHandlerV3 sets the password of the user of a
+// password reset token
+func ConfirmPasswordResetHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	var in = PasswordResetConfirm{}
+	err := decodeJSON(r, &in)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	id, err := FindPasswordResetContext(r.Context(), in.Token)
+	if err == ErrInvalidResetToken {
+		logger(r.Context()).Warn("invalid password reset token")
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot find password reset", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot reset password")
+		return
+	}
+
+	t := FindUserIDContext(r.Context(), id)
+	if t.Username == empty {
+		writeError(rw, http.StatusBadRequest, ErrInvalidResetToken.Error())
+		return
+	}
+	setRequestUser(r.Context(), t.Username)
+
+	// The token stays valid when the new password is rejected
+	if CheckPassword(t.Password, in.NewPassword) {
+		writeValidationError(rw, r, ValidationError{{Field: "new_password", Rule: "nefield",
+			Message: "must be different from the current password"}})
+		return
+	}
+	t.Password = in.NewPassword
+	err = validateChanges(t, []string{"password"})
+	if err != nil {
+		v := ValidationError{}.add(empty, err)
+		for i := range v {
+			v[i].Field = "new_password"
+		}
+		writeValidationError(rw, r, v)
+		return
+	}
+
+	err = ResetPasswordContext(r.Context(), t, in.Token)
+	if err == ErrInvalidResetToken {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot reset password", "id", t.ID, "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot reset password")
+		return
+	}
+
+	revoked, err := DeleteOtherSessionsContext(r.Context(), t.ID, empty)
+	if err != nil {
+		logger(r.Context()).Error("cannot delete sessions", "id", t.ID, "err", err)
+	}
+	audit(r.Context(), AuditPasswordReset, "user_id", t.ID, "sessions_revoked", revoked)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// resetToken creates a user with password and returns it with a
+// password reset token
+func resetToken(t *testing.T, h http.Handler, username, password string) (User, string) {
+	t.Helper()
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"`+username+`","password":"`+password+`"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	u := FindUserUsername(username)
+	token, _, err := CreatePasswordResetContext(context.Background(), u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, token
+}
+
+func TestResetRejectsCurrentPassword(t *testing.T) {
+	h := newTestServer(t)
+	_, token := resetToken(t, h, "alice", "alice-secret")
+
+	rw := serve(h, http.MethodPost, "/v3/password-resets/confirm", `{"token":"`+token+`","new_password":"alice-secret"}`)
+	expectStatus(t, rw, http.StatusUnprocessableEntity)
+	var e V3Error
+	decodeBody(t, rw, &e)
+	if len(e.Violations) != 1 || e.Violations[0].Field != "new_password" {
+		t.Fatalf("violations = %+v", e.Violations)
+	}
+
+	// The token stays valid when the new password is rejected
+	rw = serve(h, http.MethodPost, "/v3/password-resets/confirm", `{"token":"`+token+`","new_password":"alice-secret-2"}`)
+	expectStatus(t, rw, http.StatusNoContent)
+	login(t, h, "alice", "alice-secret-2")
+}
+
+func TestResetPassword(t *testing.T) {
+	h := newTestServer(t)
+	_, token := resetToken(t, h, "alice", "alice-secret")
+	session := login(t, h, "alice", "alice-secret")
+
+	body := `{"token":"` + token + `","new_password":"alice-secret-2"}`
+	rw := serve(h, http.MethodPost, "/v3/password-resets/confirm", body)
+	expectStatus(t, rw, http.StatusNoContent)
+	login(t, h, "alice", "alice-secret-2")
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", session)
+	expectStatus(t, rw, http.StatusUnauthorized)
+
+	// A token works once
+	rw = serve(h, http.MethodPost, "/v3/password-resets/confirm", `{"token":"`+token+`","new_password":"alice-secret-3"}`)
+	expectStatus(t, rw, http.StatusBadRequest)
+	rw = serve(h, http.MethodPost, "/v3/password-resets/confirm", `{"token":"not-a-token","new_password":"alice-secret-3"}`)
+	expectStatus(t, rw, http.StatusBadRequest)
+}
+
+func TestResetPasswordKeepsTokenOnFailure(t *testing.T) {
+	h := newTestServer(t)
+	u, token := resetToken(t, h, "alice", "alice-secret")
+
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TRIGGER broken BEFORE UPDATE ON users BEGIN SELECT RAISE(ABORT, 'disk is broken'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := serve(h, http.MethodPost, "/v3/password-resets/confirm", `{"token":"`+token+`","new_password":"alice-secret-2"}`)
+	expectStatus(t, rw, http.StatusInternalServerError)
+
+	// The token was not consumed by the failed reset
+	if _, err = db.Exec("DROP TRIGGER broken"); err != nil {
+		t.Fatal(err)
+	}
+	u.Password = "alice-secret-2"
+	err = ResetPasswordContext(context.Background(), u, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login(t, h, "alice", "alice-secret-2")
+	if err = ResetPasswordContext(context.Background(), u, token); err != ErrInvalidResetToken {
+		t.Fatalf("err = %v, want ErrInvalidResetToken", err)
+	}
+}
@@ -0,0 +1,73 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// NewRouter returns a router with every endpoint of the REST API
+func NewRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	getMux := r.Methods(http.MethodGet).Subrouter()
+	getMux.HandleFunc("/healthz", HealthzHandler)
+	getMux.HandleFunc("/readyz", ReadyzHandler)
+	getMux.Handle("/metrics", MetricsHandler)
+	getMux.HandleFunc("/v1/time", TimeHandler)
+	getMux.HandleFunc("/v1/getall", GetAllHandlerUpdated)
+	getMux.HandleFunc("/v1/getid", GetIDHandler)
+	getMux.HandleFunc("/v1/logged", LoggedUsersHandler)
+	getMux.HandleFunc("/v1/username/{id:[0-9]+}", GetUserDataHandler)
+	getMux.HandleFunc("/v2/getall", GetAllHandlerV2)
+	getMux.Handle("/v2/files/{filename:[a-zA-Z0-9][a-zA-Z0-9\\.]*[a-zA-Z0-9]}",
+		http.StripPrefix("/v2/files/", http.FileServer(http.Dir(IMAGESPATH))))
+
+	putMux := r.Methods(http.MethodPut).Subrouter()
+	putMux.HandleFunc("/v1/update", UpdateHandler)
+	putMux.HandleFunc("/v2/files/{filename:[a-zA-Z0-9][a-zA-Z0-9\\.]*[a-zA-Z0-9]}", UploadFile)
+
+	postMux := r.Methods(http.MethodPost).Subrouter()
+	postMux.HandleFunc("/v1/add", AddHandler)
+	postMux.HandleFunc("/v1/login", LoginHandler)
+	postMux.HandleFunc("/v1/logout", LogoutHandler)
+	postMux.HandleFunc("/v2/add", AddHandlerV2)
+	postMux.HandleFunc("/v2/login", LoginHandlerV2)
+	postMux.HandleFunc("/v2/logout", LogoutHandlerV2)
+
+	deleteMux := r.Methods(http.MethodDelete).Subrouter()
+	deleteMux.HandleFunc("/v1/username/{id:[0-9]+}", DeleteHandler)
+
+	RegisterV3Routes(r)
+
+	// Middlewares only run for matched routes, so the
+	// fallback handlers are counted explicitly
+	r.NotFoundHandler = instrument(http.HandlerFunc(DefaultHandler))
+	r.MethodNotAllowedHandler = instrument(http.HandlerFunc(MethodNotAllowedHandler))
+	r.Use(RequestIDMiddleWare, TracingMiddleWare, MetricsMiddleWare, MiddleWare,
+		RecoverMiddleWare, CORSMiddleWare, RateLimitMiddleWare, BodyLimitMiddleWare,
+		TimeoutMiddleWare)
+	return r
+}
+
+// matchRoute returns true when a request with method, route template and
+// path matches pattern, which is a route template or a path prefix that
+// ends with *, and patternMethod, which matches every method when empty
+func matchRoute(pattern, patternMethod, method, route, path string) bool {
+	if patternMethod != empty && !strings.EqualFold(patternMethod, method) {
+		return false
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == route
+}
+
+// instrument wraps the handlers that do not belong to a route
+// with the middlewares of NewRouter
+func instrument(h http.Handler) http.Handler {
+	return RequestIDMiddleWare(TracingMiddleWare(MetricsMiddleWare(MiddleWare(
+		RecoverMiddleWare(CORSMiddleWare(RateLimitMiddleWare(BodyLimitMiddleWare(
+			TimeoutMiddleWare(h)))))))))
+}
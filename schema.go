@@ -0,0 +1,86 @@
+package shandler
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// migrations defines the changes to the database schema in order.
+// Migration i brings the schema to version i+1, which is stored
+// in the user_version pragma of the SQLite3 database.
+var migrations = []string{
+	"CREATE TABLE IF NOT EXISTS users (ID integer NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Password TEXT, Lastlogin integer, Admin integer, Active integer);",
+	"CREATE TABLE IF NOT EXISTS sessions (ID integer NOT NULL PRIMARY KEY AUTOINCREMENT, UserID integer, Token TEXT UNIQUE, Created integer, Expires integer);",
+	"ALTER TABLE users ADD COLUMN Version integer NOT NULL DEFAULT 1;",
+	"ALTER TABLE users ADD COLUMN Email TEXT NOT NULL DEFAULT '';",
+	"CREATE TABLE IF NOT EXISTS password_resets (ID integer NOT NULL PRIMARY KEY AUTOINCREMENT, UserID integer, Token TEXT UNIQUE, Created integer, Expires integer);",
+	"ALTER TABLE users ADD COLUMN EmailVerified integer NOT NULL DEFAULT 0;",
+	"UPDATE users SET Email = lower(trim(Email));",
+	// The first user of an email address keeps it
+	"UPDATE users SET Email = '' WHERE Email <> '' AND ID NOT IN (SELECT MIN(ID) FROM users WHERE Email <> '' GROUP BY Email);",
+	"CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users(Email) WHERE Email <> '';",
+	"CREATE TABLE IF NOT EXISTS email_verifications (ID integer NOT NULL PRIMARY KEY AUTOINCREMENT, UserID integer, Email TEXT, Token TEXT UNIQUE, Created integer, Expires integer);",
+	"ALTER TABLE users ADD COLUMN Attributes TEXT NOT NULL DEFAULT '{}';",
+}
+
+// LatestSchemaVersion returns the schema version that Migrate creates
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the schema version of the database
+func SchemaVersion() (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Migrate applies the migrations that the database is missing.
+// Each migration runs in its own transaction.
+func Migrate() bool {
+	defer observeQuery("migrate")()
+
+	version, err := SchemaVersion()
+	if err != nil {
+		slog.Error("cannot read schema version", "err", err)
+		return false
+	}
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return false
+	}
+
+	for i := version; i < len(migrations); i++ {
+		slog.Info("applying migration", "version", i+1)
+		tx, err := db.Begin()
+		if err != nil {
+			slog.Error("cannot begin transaction", "err", err)
+			return false
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err == nil {
+			// PRAGMA statements do not accept parameters
+			_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(i+1))
+		}
+		if err != nil {
+			slog.Error("migration failed", "version", i+1, "err", err)
+			tx.Rollback()
+			return false
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			slog.Error("migration failed", "version", i+1, "err", err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package shandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Server runs the REST API and manages its lifecycle
+type Server struct {
+	mutex    sync.Mutex
+	config   Config
+	http     *http.Server
+	hooks    []func(context.Context) error
+	inflight sync.WaitGroup
+	stopping bool
+	stopped  chan struct{}
+	err      error
+}
+
+// NewServer returns a Server for the given configuration
+func NewServer(c Config) *Server {
+	return &Server{config: c, stopped: make(chan struct{})}
+}
+
+// Config returns the current configuration of the server
+func (s *Server) Config() Config {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config
+}
+
+// OnShutdown registers f to be called by Shutdown after the last request
+// has finished and before the database is closed
+func (s *Server) OnShutdown(f func(context.Context) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = append(s.hooks, f)
+}
+
+// track counts the requests in progress, so that Shutdown can wait
+// for them even after connections have been closed forcibly
+func (s *Server) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s.inflight.Add(1)
+		defer s.inflight.Done()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Start prepares the images directory and the database and serves requests.
+// It blocks until Shutdown has finished and returns the error of Shutdown.
+// When Shutdown is called while Start is still preparing, Start stops
+// before serving and shuts down itself.
+func (s *Server) Start() error {
+	c := s.Config()
+	level, err := ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	err = SetupLogging(os.Stderr, c.LogFormat, level)
+	if err != nil {
+		return err
+	}
+	c.Apply()
+
+	a, err := NewAccessLogger(os.Stdout, c)
+	if err != nil {
+		return err
+	}
+	SetAccessLogger(a)
+	cors, err := NewCORS(c)
+	if err != nil {
+		return err
+	}
+	SetCORS(cors)
+	SetRateLimiter(NewRateLimiter(c.RateLimits, rateLimitStore))
+	SetTimeouts(NewTimeouts(c.HandlerTimeout.Duration, c.HandlerTimeouts))
+	SetBodyLimits(NewBodyLimits(c.MaxBodyBytes, c.BodyLimits))
+	n, err := NewNotifier(c)
+	if err != nil {
+		return err
+	}
+	SetNotifier(n)
+	schema, err := LoadAttributesSchema(c.AttributesSchema)
+	if err != nil {
+		return err
+	}
+	SetAttributesSchema(schema)
+
+	err = CreateImageDirectory(c.Images)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(c.Database)
+	if os.IsNotExist(err) {
+		password, ok := CreateDatabase()
+		if !ok {
+			return errors.New("cannot create " + c.Database)
+		}
+		// The password is only shown here, and kept out of the logs
+		fmt.Fprintln(os.Stderr, "Created", c.Database, "with user admin and password", password)
+	} else if !Migrate() {
+		return errors.New("cannot migrate " + c.Database)
+	}
+
+	flush, err := SetupTracing(c.TraceExporter, c.TraceEndpoint, c.TraceSampleRatio)
+	if err != nil {
+		return err
+	}
+	s.OnShutdown(flush)
+
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		ln.Close()
+		slog.Info("shut down before serving")
+		ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout.Duration)
+		defer cancel()
+		return s.finish(ctx, nil)
+	}
+	s.http = &http.Server{
+		Handler:      s.track(NewRouter()),
+		ReadTimeout:  c.ReadTimeout.Duration,
+		WriteTimeout: c.WriteTimeout.Duration,
+		IdleTimeout:  c.IdleTimeout.Duration,
+	}
+	srv := s.http
+	s.mutex.Unlock()
+
+	slog.Info("listening", "addr", ln.Addr().String())
+	err = srv.Serve(ln)
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	<-s.stopped
+	return s.err
+}
+
+// Shutdown stops accepting connections and waits for the requests in
+// progress until ctx is done, when the remaining connections are closed.
+// Then it waits for the messages that are being sent, deletes expired
+// sessions, password reset and email verification tokens, calls the
+// OnShutdown functions and closes the database. When Start is not
+// serving yet, Shutdown returns at once and Start does all of this.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	srv := s.http
+	s.mutex.Unlock()
+
+	if srv == nil {
+		logger(ctx).Info("shutting down before serving")
+		return nil
+	}
+
+	logger(ctx).Info("shutting down")
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		logger(ctx).Warn("closing connections", "err", err)
+		srv.Close()
+	}
+	s.inflight.Wait()
+	return s.finish(ctx, err)
+}
+
+// finish does the work of Shutdown that follows the last request, where err
+// is the error of closing the connections, and ends Start
+func (s *Server) finish(ctx context.Context, err error) error {
+	s.mutex.Lock()
+	hooks := s.hooks
+	s.mutex.Unlock()
+
+	waitNotifications(ctx)
+
+	if !DeleteExpiredSessions() {
+		logger(ctx).Error("cannot delete expired sessions")
+	}
+	if !DeleteExpiredPasswordResets() {
+		logger(ctx).Error("cannot delete expired password resets")
+	}
+	if !DeleteExpiredEmailVerifications() {
+		logger(ctx).Error("cannot delete expired email verifications")
+	}
+
+	for _, f := range hooks {
+		hookErr := f(ctx)
+		if hookErr != nil {
+			logger(ctx).Error("shutdown function failed", "err", hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+
+	closeErr := CloseDatabase()
+	if err == nil {
+		err = closeErr
+	}
+
+	s.err = err
+	close(s.stopped)
+	return err
+}
+
+// Reload applies the settings of c that can change while the server runs:
+// session_ttl, require_if_match, batch_limit, min_free_disk_mb, log_level,
+// the access_log settings, the cors settings, rate_limits, the handler
+// timeouts, the body limits, the password_reset settings, the
+// email_verification settings, attributes_schema and the notifier settings.
+// The other settings need a restart, which is logged when they are different.
+func (s *Server) Reload(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	a, err := NewAccessLogger(os.Stdout, c)
+	if err != nil {
+		return err
+	}
+	cors, err := NewCORS(c)
+	if err != nil {
+		return err
+	}
+	n, err := NewNotifier(c)
+	if err != nil {
+		return err
+	}
+	schema, err := LoadAttributesSchema(c.AttributesSchema)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := s.config
+	if c.Listen != old.Listen || c.Database != old.Database || c.Images != old.Images ||
+		c.ReadTimeout != old.ReadTimeout || c.WriteTimeout != old.WriteTimeout ||
+		c.IdleTimeout != old.IdleTimeout || c.ShutdownTimeout != old.ShutdownTimeout ||
+		c.TraceExporter != old.TraceExporter || c.TraceEndpoint != old.TraceEndpoint ||
+		c.TraceSampleRatio != old.TraceSampleRatio || c.LogFormat != old.LogFormat {
+		slog.Warn("changes to listen, database, images, timeouts, tracing and log_format need a restart")
+	}
+
+	s.config.SessionTTL = c.SessionTTL
+	s.config.RequireIfMatch = c.RequireIfMatch
+	s.config.BatchLimit = c.BatchLimit
+	s.config.MinFreeDisk = c.MinFreeDisk
+	s.config.LogLevel = c.LogLevel
+	s.config.AccessLogFormat = c.AccessLogFormat
+	s.config.AccessLogTemplate = c.AccessLogTemplate
+	s.config.AccessLogSampleRatio = c.AccessLogSampleRatio
+	s.config.AccessLogExclude = c.AccessLogExclude
+	s.config.CORSAllowedOrigins = c.CORSAllowedOrigins
+	s.config.CORSAllowedMethods = c.CORSAllowedMethods
+	s.config.CORSAllowedHeaders = c.CORSAllowedHeaders
+	s.config.CORSExposedHeaders = c.CORSExposedHeaders
+	s.config.CORSAllowCredentials = c.CORSAllowCredentials
+	s.config.CORSMaxAge = c.CORSMaxAge
+	s.config.RateLimits = c.RateLimits
+	s.config.HandlerTimeout = c.HandlerTimeout
+	s.config.HandlerTimeouts = c.HandlerTimeouts
+	s.config.MaxBodyBytes = c.MaxBodyBytes
+	s.config.BodyLimits = c.BodyLimits
+	s.config.PasswordResetTTL = c.PasswordResetTTL
+	s.config.PasswordResetURL = c.PasswordResetURL
+	s.config.PasswordResetRequests = c.PasswordResetRequests
+	s.config.PasswordResetPer = c.PasswordResetPer
+	s.config.EmailVerificationTTL = c.EmailVerificationTTL
+	s.config.EmailVerificationURL = c.EmailVerificationURL
+	s.config.AttributesSchema = c.AttributesSchema
+	s.config.Notifier = c.Notifier
+	s.config.NotifyFile = c.NotifyFile
+	s.config.SMTPAddr = c.SMTPAddr
+	s.config.SMTPFrom = c.SMTPFrom
+	s.config.SMTPUsername = c.SMTPUsername
+	s.config.SMTPPassword = c.SMTPPassword
+
+	SESSIONTTL = c.SessionTTL.Duration
+	REQUIREIFMATCH = c.RequireIfMatch
+	BATCHLIMIT = c.BatchLimit
+	MINFREEDISK = c.MinFreeDisk
+	RESETTTL = c.PasswordResetTTL.Duration
+	RESETURL = c.PasswordResetURL
+	RESETREQUESTS = c.PasswordResetRequests
+	RESETPER = c.PasswordResetPer.Duration
+	VERIFYTTL = c.EmailVerificationTTL.Duration
+	VERIFYURL = c.EmailVerificationURL
+	level, _ := ParseLevel(c.LogLevel)
+	LOGLEVEL.Set(level)
+	SetAccessLogger(a)
+	SetCORS(cors)
+	SetRateLimiter(NewRateLimiter(c.RateLimits, rateLimitStore))
+	SetTimeouts(NewTimeouts(c.HandlerTimeout.Duration, c.HandlerTimeouts))
+	SetBodyLimits(NewBodyLimits(c.MaxBodyBytes, c.BodyLimits))
+	SetNotifier(n)
+	SetAttributesSchema(schema)
+	slog.Info("configuration reloaded")
+	return nil
+}
@@ -0,0 +1,87 @@
+package shandler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfig returns the configuration of a server on a random port
+// that keeps its files in a temporary directory
+func testConfig(t *testing.T) Config {
+	c := DefaultConfig()
+	c.Listen = "127.0.0.1:0"
+	c.Database = filepath.Join(t.TempDir(), "users.db")
+	c.Images = t.TempDir()
+	c.ShutdownTimeout = Duration{5 * time.Second}
+	return c
+}
+
+// startServer runs s.Start and returns the channel of its error
+func startServer(s *Server) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+	return done
+}
+
+// waitStart returns the error of Start, failing t when it does not return
+func waitStart(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+	return nil
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := NewServer(testConfig(t))
+	done := startServer(s)
+
+	for {
+		s.mutex.Lock()
+		serving := s.http != nil
+		s.mutex.Unlock()
+		if serving {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = waitStart(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerShutdownBeforeServing(t *testing.T) {
+	s := NewServer(testConfig(t))
+	called := false
+	s.OnShutdown(func(context.Context) error {
+		called = true
+		return nil
+	})
+
+	// The signal can arrive while Start is still migrating
+	err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = waitStart(t, startServer(s)); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("the OnShutdown functions were not called")
+	}
+	if s.http != nil {
+		t.Fatal("the server served after Shutdown")
+	}
+}
@@ -0,0 +1,308 @@
+package shandler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// SESSIONTTL defines how long a session token remains valid
+var SESSIONTTL = 24 * time.Hour
+
+// Session defines the structure for a login session of a User
+// swagger:model Session
+type Session struct {
+	// The ID of the Session
+	//
+	// required: true
+	ID int `json:"id"`
+	// The ID of the User that owns the Session
+	//
+	// required: true
+	UserID int `json:"userid"`
+	// The creation time of the Session
+	//
+	// required: true
+	Created int64 `json:"created"`
+	// The expiration time of the Session
+	//
+	// required: true
+	Expires int64 `json:"expires"`
+}
+
+// hashToken returns the value that is stored in the database for a token.
+// Tokens are never stored in plain text.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random token of n bytes encoded as hex
+func newToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return empty, err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateSession creates a new session for the given user ID
+// and returns the token that identifies it
+func CreateSession(userID int) (string, Session, error) {
+	return CreateSessionContext(context.Background(), userID)
+}
+
+// CreateSessionContext is like CreateSession, with ctx for tracing and cancellation
+func CreateSessionContext(ctx context.Context, userID int) (string, Session, error) {
+	ctx, end := startOperation(ctx, "CreateSession", "create_session")
+	defer end()
+
+	token, err := newToken(32)
+	if err != nil {
+		return empty, Session{}, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return empty, Session{}, err
+	}
+
+	now := time.Now()
+	s := Session{
+		UserID:  userID,
+		Created: now.Unix(),
+		Expires: now.Add(SESSIONTTL).Unix(),
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO sessions(UserID, Token, Created, Expires) values(?,?,?,?)",
+		s.UserID, hashToken(token), s.Created, s.Expires)
+	if err != nil {
+		return empty, Session{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return empty, Session{}, err
+	}
+	s.ID = int(id)
+	return token, s, nil
+}
+
+// FindSession returns the session identified by token.
+// Expired sessions are not returned.
+func FindSession(token string) (Session, bool) {
+	return FindSessionContext(context.Background(), token)
+}
+
+// FindSessionContext is like FindSession, with ctx for tracing and cancellation
+func FindSessionContext(ctx context.Context, token string) (Session, bool) {
+	ctx, end := startOperation(ctx, "FindSession", "find_session")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		logger(ctx).Error("cannot open database", "err", err)
+		return Session{}, false
+	}
+
+	s := Session{}
+	row := db.QueryRowContext(ctx, "SELECT ID, UserID, Created, Expires FROM sessions WHERE Token = ?", hashToken(token))
+	err = row.Scan(&s.ID, &s.UserID, &s.Created, &s.Expires)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger(ctx).Error("cannot find session", "err", err)
+		}
+		return Session{}, false
+	}
+
+	if s.Expires < time.Now().Unix() {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// DeleteSession is for deleting the session identified by token
+func DeleteSession(token string) bool {
+	return DeleteSessionContext(context.Background(), token)
+}
+
+// DeleteSessionContext is like DeleteSession, with ctx for tracing and cancellation
+func DeleteSessionContext(ctx context.Context, token string) bool {
+	ctx, end := startOperation(ctx, "DeleteSession", "delete_session")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		logger(ctx).Error("cannot open database", "err", err)
+		return false
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM sessions WHERE Token = ?", hashToken(token))
+	if err != nil {
+		logger(ctx).Error("cannot delete session", "err", err)
+		return false
+	}
+	return true
+}
+
+// DeleteUserSessions is for deleting all sessions of a user
+func DeleteUserSessions(userID int) bool {
+	return DeleteUserSessionsContext(context.Background(), userID)
+}
+
+// DeleteUserSessionsContext is like DeleteUserSessions, with ctx for tracing and cancellation
+func DeleteUserSessionsContext(ctx context.Context, userID int) bool {
+	ctx, end := startOperation(ctx, "DeleteUserSessions", "delete_session")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		logger(ctx).Error("cannot open database", "err", err)
+		return false
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM sessions WHERE UserID = ?", userID)
+	if err != nil {
+		logger(ctx).Error("cannot delete sessions", "user_id", userID, "err", err)
+		return false
+	}
+	return true
+}
+
+// DeleteOtherSessionsContext deletes the sessions of a user except the one
+// identified by token, or all of them when token is empty, and returns how
+// many were deleted
+func DeleteOtherSessionsContext(ctx context.Context, userID int, token string) (int64, error) {
+	ctx, end := startOperation(ctx, "DeleteOtherSessions", "delete_session")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE UserID = ? AND Token <> ?", userID, hashToken(token))
+	if err != nil {
+		traceError(ctx, err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CountUserSessionsContext returns the number of sessions
+// of a user that have not expired
+func CountUserSessionsContext(ctx context.Context, userID int) (int, error) {
+	ctx, end := startOperation(ctx, "CountUserSessions", "count_sessions")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE UserID = ? AND Expires >= ?",
+		userID, time.Now().Unix()).Scan(&count)
+	traceError(ctx, err)
+	return count, err
+}
+
+// execRevokeCredentials deletes every session and password reset token of
+// a user using q, for the transactions that change passwords. It returns
+// the number of deleted sessions.
+func execRevokeCredentials(q execer, userID int) (int64, error) {
+	res, err := q.Exec("DELETE FROM sessions WHERE UserID = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = q.Exec("DELETE FROM password_resets WHERE UserID = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// logoutUser clears the Active field of t after a logout, unless t has
+// other sessions, so that users stay active while they are logged in
+// elsewhere
+func logoutUser(ctx context.Context, t User) error {
+	remaining, err := CountUserSessionsContext(ctx, t.ID)
+	if err != nil || remaining != 0 {
+		return err
+	}
+	t.Active = 0
+	return updateUser(ctx, t, []string{"active"}, 0)
+}
+
+// ReturnAllSessions is for returning all sessions that have not expired
+func ReturnAllSessions() []Session {
+	defer observeQuery("list_sessions")()
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return nil
+	}
+
+	rows, err := db.Query("SELECT ID, UserID, Created, Expires FROM sessions WHERE Expires >= ? ORDER BY ID", time.Now().Unix())
+	if err != nil {
+		slog.Error("cannot list sessions", "err", err)
+		return nil
+	}
+	defer rows.Close()
+
+	all := []Session{}
+	for rows.Next() {
+		s := Session{}
+		err = rows.Scan(&s.ID, &s.UserID, &s.Created, &s.Expires)
+		if err != nil {
+			slog.Error("cannot read row", "err", err)
+			return nil
+		}
+		all = append(all, s)
+	}
+	return all
+}
+
+// DeleteSessionID is for deleting a session defined by ID
+func DeleteSessionID(ID int) bool {
+	defer observeQuery("delete_session")()
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return false
+	}
+
+	res, err := db.Exec("DELETE FROM sessions WHERE ID = ?", ID)
+	if err != nil {
+		slog.Error("cannot delete session", "id", ID, "err", err)
+		return false
+	}
+
+	affect, err := res.RowsAffected()
+	return err == nil && affect == 1
+}
+
+// DeleteExpiredSessions is for deleting the sessions that have expired
+func DeleteExpiredSessions() bool {
+	defer observeQuery("delete_expired_sessions")()
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return false
+	}
+
+	_, err = db.Exec("DELETE FROM sessions WHERE Expires < ?", time.Now().Unix())
+	if err != nil {
+		slog.Error("cannot delete expired sessions", "err", err)
+		return false
+	}
+	return true
+}
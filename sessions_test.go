@@ -0,0 +1,124 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// login creates a session for username and password
+// and returns its Authorization header
+func login(t *testing.T, h http.Handler, username, password string) string {
+	t.Helper()
+	rw := serve(h, http.MethodPost, "/v3/sessions", `{"user":"`+username+`","password":"`+password+`"}`)
+	expectStatus(t, rw, http.StatusCreated)
+	var token V3Token
+	decodeBody(t, rw, &token)
+	return "Bearer " + token.Token
+}
+
+func TestLogoutKeepsOtherSessions(t *testing.T) {
+	h := newTestServer(t)
+	phone := login(t, h, "admin", "admin")
+	laptop := login(t, h, "admin", "admin")
+
+	rw := serve(h, http.MethodDelete, "/v3/sessions", empty, "Authorization", phone)
+	expectStatus(t, rw, http.StatusNoContent)
+	if FindUserID(1).Active != 1 {
+		t.Fatal("user is not active with a session left")
+	}
+
+	rw = serve(h, http.MethodDelete, "/v3/sessions", empty, "Authorization", laptop)
+	expectStatus(t, rw, http.StatusNoContent)
+	if FindUserID(1).Active != 0 {
+		t.Fatal("user is active without sessions")
+	}
+}
+
+func TestAdminPasswordChangeRevokesSessions(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	alice := login(t, h, "alice", "alice-secret")
+	admin := login(t, h, "admin", "admin")
+
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"password":"alice-secret-2"}`, "Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusUnauthorized)
+
+	// Other changes keep the sessions
+	alice = login(t, h, "alice", "alice-secret-2")
+	rw = serve(h, http.MethodPatch, "/v3/users/2", `{"email":"alice@example.com"}`, "Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusOK)
+
+	// The session of an administrator that changes its own password stays valid
+	other := login(t, h, "admin", "admin")
+	rw = serve(h, http.MethodPatch, "/v3/users/1", `{"password":"admin-secret"}`, "Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/1", empty, "Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/1", empty, "Authorization", other)
+	expectStatus(t, rw, http.StatusUnauthorized)
+
+	rw = serve(h, http.MethodPost, "/v3/users/batch", `{"operations":[{"op":"update","id":2,"user":{"password":"alice-secret-3"}}]}`,
+		"Authorization", admin)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusUnauthorized)
+}
+
+func TestV1V2LogoutKeepsSessionUsers(t *testing.T) {
+	h := newTestServer(t)
+	session := login(t, h, "admin", "admin")
+
+	logouts := []struct {
+		path, body string
+	}{
+		{"/v1/logout", `{"user":"admin","password":"admin"}`},
+		{"/v2/logout", `{"username":"admin","password":"admin"}`},
+	}
+	for _, l := range logouts {
+		rw := serve(h, http.MethodPost, l.path, l.body)
+		expectStatus(t, rw, http.StatusOK)
+		if FindUserID(1).Active != 1 {
+			t.Fatalf("%s: user is not active with a session left", l.path)
+		}
+	}
+
+	rw := serve(h, http.MethodDelete, "/v3/sessions", empty, "Authorization", session)
+	expectStatus(t, rw, http.StatusNoContent)
+	rw = serve(h, http.MethodPost, "/v1/login", `{"user":"admin","password":"admin"}`)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodPost, "/v1/logout", `{"user":"admin","password":"admin"}`)
+	expectStatus(t, rw, http.StatusOK)
+	if FindUserID(1).Active != 0 {
+		t.Fatal("user is active without sessions")
+	}
+}
+
+func TestV1UpdateRevokesSessions(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+	alice := login(t, h, "alice", "alice-secret")
+	logs := captureLogs(t)
+
+	// The same password is not a change
+	rw = serve(h, http.MethodPut, "/v1/update", `[{"user":"admin","password":"admin"},{"user":"alice","password":"alice-secret","admin":0}]`)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusOK)
+
+	rw = serve(h, http.MethodPut, "/v1/update", `[{"user":"admin","password":"admin"},{"user":"alice","password":"alice-secret-2","admin":0}]`)
+	expectStatus(t, rw, http.StatusOK)
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusUnauthorized)
+	if !strings.Contains(logs.String(), `"event":"password_changed"`) {
+		t.Fatalf("logs = %s", logs.String())
+	}
+}
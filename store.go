@@ -0,0 +1,59 @@
+package shandler
+
+import (
+	"database/sql"
+	"log/slog"
+	"sync"
+)
+
+var (
+	// dbMutex protects dbHandle and dbPath
+	dbMutex sync.Mutex
+	// dbHandle is the database handle that all functions share
+	dbHandle *sql.DB
+	// dbPath is the value of SQLFILE that dbHandle was opened with
+	dbPath string
+)
+
+// openDB returns the shared handle of the database at SQLFILE.
+// The handle is opened on first use and reopened when SQLFILE changes.
+// Callers must not close it, use CloseDatabase instead.
+func openDB() (*sql.DB, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if dbHandle != nil && dbPath == SQLFILE {
+		return dbHandle, nil
+	}
+
+	if dbHandle != nil {
+		dbHandle.Close()
+		dbHandle = nil
+	}
+
+	// Concurrent writers wait for each other instead of failing
+	// with "database is locked"
+	db, err := sql.Open("sqlite3", SQLFILE+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	dbHandle = db
+	dbPath = SQLFILE
+	return db, nil
+}
+
+// CloseDatabase closes the shared database handle.
+// The next database call opens it again.
+func CloseDatabase() error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if dbHandle == nil {
+		return nil
+	}
+
+	slog.Info("closing database", "database", dbPath)
+	err := dbHandle.Close()
+	dbHandle = nil
+	return err
+}
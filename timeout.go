@@ -0,0 +1,110 @@
+package shandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RouteTimeout overrides the handler timeout of the requests that match
+// Route and Method, which work as in RateLimitRule. A zero Timeout
+// disables the timeout, which streaming responses need.
+type RouteTimeout struct {
+	Route   string   `yaml:"route" toml:"route"`
+	Method  string   `yaml:"method,omitempty" toml:"method,omitempty"`
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// validate returns the problems of t
+func (t RouteTimeout) validate() error {
+	if t.Route == empty {
+		return errors.New("route is required")
+	}
+	if t.Timeout.Duration < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	return nil
+}
+
+// Timeouts defines how long handlers can take
+type Timeouts struct {
+	def    time.Duration
+	routes []RouteTimeout
+}
+
+// NewTimeouts returns Timeouts with a default timeout and the timeouts
+// of specific routes, the first matching RouteTimeout applies
+func NewTimeouts(def time.Duration, routes []RouteTimeout) *Timeouts {
+	return &Timeouts{def: def, routes: routes}
+}
+
+// timeout returns the timeout of r, zero when there is none
+func (t *Timeouts) timeout(r *http.Request) time.Duration {
+	route := routeTemplate(r)
+	for _, rt := range t.routes {
+		if matchRoute(rt.Route, rt.Method, r.Method, route, r.URL.Path) {
+			return rt.Timeout.Duration
+		}
+	}
+	return t.def
+}
+
+// handlerTimeouts are the Timeouts of TimeoutMiddleWare, nil when disabled
+var handlerTimeouts atomic.Pointer[Timeouts]
+
+func init() {
+	c := DefaultConfig()
+	handlerTimeouts.Store(NewTimeouts(c.HandlerTimeout.Duration, c.HandlerTimeouts))
+}
+
+// SetTimeouts replaces the Timeouts of TimeoutMiddleWare.
+// Nil Timeouts disable the handler timeouts.
+func SetTimeouts(t *Timeouts) {
+	handlerTimeouts.Store(t)
+}
+
+// jsonTimeoutWriter sets the Content-Type of the error of http.TimeoutHandler,
+// which only writes its body
+type jsonTimeoutWriter struct {
+	http.ResponseWriter
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w jsonTimeoutWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == empty {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// TimeoutMiddleWare answers with 503 Service Unavailable when a handler
+// takes longer than its timeout, as http.TimeoutHandler does. The context
+// of the request is canceled, so that the store calls of the handler stop.
+// Responses are buffered until the handler returns, so streaming routes
+// need a zero timeout.
+func TimeoutMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		t := handlerTimeouts.Load()
+		if t == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		d := t.timeout(r)
+		if d <= 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		// The handler writes to the headers of http.TimeoutHandler,
+		// which do not have the ID that writeError reports
+		id := RequestID(r.Context())
+		h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(RequestIDHeader, id)
+			next.ServeHTTP(rw, r)
+		})
+		body, _ := json.Marshal(V3Error{Error: "request timed out", RequestID: id})
+		http.TimeoutHandler(h, d, string(body)).ServeHTTP(jsonTimeoutWriter{rw}, r)
+	})
+}
@@ -0,0 +1,132 @@
+package shandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceNone disables tracing
+	TraceNone = "none"
+	// TraceStdout writes spans to the standard output
+	TraceStdout = "stdout"
+	// TraceOTLP sends spans to an OTLP/HTTP collector
+	TraceOTLP = "otlp"
+)
+
+// tracerName identifies the spans that shandler creates
+const tracerName = "github.com/mactsouk/shandler"
+
+// tracer returns the tracer of the global TracerProvider.
+// Until SetupTracing is called, it creates spans that are not recorded.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// SetupTracing installs the global TracerProvider that exporter defines
+// and the W3C Trace Context propagator. endpoint is the host:port of the
+// OTLP/HTTP collector and ratio is the fraction of traces to sample.
+// The returned function flushes the spans that have not been exported.
+func SetupTracing(exporter, endpoint string, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case TraceNone, empty:
+		return func(context.Context) error { return nil }, nil
+	case TraceStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceOTLP:
+		exp, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	default:
+		return nil, errors.New("unknown trace exporter " + exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", "shandler")))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startOperation starts the span of a store call and, when metric is
+// not empty, times it in the shandler_db_query_duration_seconds histogram.
+// Call the returned function when the operation is complete.
+func startOperation(ctx context.Context, name, metric string) (context.Context, func()) {
+	ctx, span := tracer().Start(ctx, name,
+		trace.WithAttributes(attribute.String("db.system", "sqlite")))
+	observe := func() {}
+	if metric != empty {
+		observe = observeQuery(metric)
+	}
+	return ctx, func() {
+		observe()
+		span.End()
+	}
+}
+
+// TracingMiddleWare starts a server span for every request, continuing
+// the trace of the traceparent header when there is one
+func TracingMiddleWare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("user_agent.original", r.UserAgent()),
+				attribute.String("http.request.id", RequestID(r.Context())),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceError records err on the span of ctx
+func traceError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,89 @@
+package shandler
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a TracerProvider that records the spans in memory
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return sr
+}
+
+func TestTracingPropagation(t *testing.T) {
+	h := newTestServer(t)
+	sr := recordSpans(t)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	rw := serve(h, http.MethodGet, "/v1/username/1", empty, "traceparent", traceparent)
+	expectStatus(t, rw, http.StatusOK)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["GET /v1/username/{id:[0-9]+}"]
+	if !ok {
+		t.Fatalf("no server span in %v", spans)
+	}
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("kind = %v", server.SpanKind())
+	}
+
+	// The request continues the trace of the client
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.Parent().SpanID().String() != "00f067aa0ba902b7" || !server.Parent().IsRemote() {
+		t.Fatalf("trace = %v, parent = %v", server.SpanContext().TraceID(), server.Parent().SpanID())
+	}
+	attributes := map[string]string{}
+	for _, a := range server.Attributes() {
+		attributes[string(a.Key)] = a.Value.Emit()
+	}
+	if attributes["http.route"] != "/v1/username/{id:[0-9]+}" || attributes["http.response.status_code"] != "200" ||
+		attributes["http.request.id"] == empty {
+		t.Fatalf("attributes = %v", attributes)
+	}
+
+	// The database calls are children of the request
+	find, ok := spans["FindUserID"]
+	if !ok {
+		t.Fatalf("no database span in %v", spans)
+	}
+	if find.Parent().SpanID() != server.SpanContext().SpanID() || find.SpanContext().TraceID() != server.SpanContext().TraceID() {
+		t.Fatalf("parent = %v, want %v", find.Parent().SpanID(), server.SpanContext().SpanID())
+	}
+}
+
+func TestTracingStartsTraces(t *testing.T) {
+	h := newTestServer(t)
+	sr := recordSpans(t)
+
+	serve(h, http.MethodGet, "/v1/username/1", empty)
+	serve(h, http.MethodGet, "/v1/username/1", empty)
+	ended := sr.Ended()
+	roots := map[trace.TraceID]bool{}
+	for _, s := range ended {
+		if !s.Parent().IsValid() {
+			roots[s.SpanContext().TraceID()] = true
+		}
+	}
+	if len(roots) != 2 {
+		t.Fatalf("%d traces, want one per request", len(roots))
+	}
+}
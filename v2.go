@@ -1,17 +1,20 @@
 package shandler
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // User defines the structure for the payload of V2 of the REST API
@@ -20,15 +23,15 @@ type V2Input struct {
 	// The Username of the user issuing the command
 	//
 	// required: true
-	Username string `json:"username"`
+	Username string `json:"username" validate:"required"`
 	// The Password of the user issuing the command
 	//
 	// required: true
-	Password string `json:"password"`
+	Password string `json:"password" validate:"required"`
 	// The User that the command will affect
 	//
 	// required: false
-	U User `json:"load"`
+	U UserCreate `json:"load" validate:"-"`
 }
 
 // IMAGESPATH defines the path where binary files are stored
@@ -40,41 +43,40 @@ var IMAGESPATH string
 // responses:
 //	200: OK
 //  400: BadRequest
+//	403: V3Error
+//	422: V3Error
 
 // AddHandlerV2 is for adding new users /v2/add
 func AddHandlerV2(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
+	var load = v2InputBody{}
+	err := decodeJSON(r, &load)
 	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if len(d) == 0 {
+	logger(r.Context()).Debug("request", "username", load.Username)
+
+	u := UserPass{load.Username, load.Password}
+	caller, ok := adminCaller(r.Context(), u)
+	if !ok {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", u.Username)
 		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
 		return
 	}
 
-	var load = V2Input{}
-	err = json.Unmarshal(d, &load)
+	err = checkWritable(caller.Role(), load.U.fields())
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writePermissionError(rw, r, ValidationError{}.add("load.", err))
 		return
 	}
-
-	log.Println(load)
-
-	u := UserPass{load.Username, load.Password}
-	if !IsUserAdmin(u) {
-		log.Println("Command issued by non-admin user:", u.Username)
-		rw.WriteHeader(http.StatusBadRequest)
+	err = load.U.Validate()
+	if err != nil {
+		writeValidationError(rw, r, ValidationError{}.add("load.", err))
 		return
 	}
 
-	newUser := load.U
-	result := AddUser(newUser)
+	result := AddUserContext(r.Context(), load.U.NewUser())
 	if !result {
 		rw.WriteHeader(http.StatusBadRequest)
 	}
@@ -88,43 +90,30 @@ func AddHandlerV2(rw http.ResponseWriter, r *http.Request) {
 //  400: BadRequest
 
 func LoginHandlerV2(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var load = V2Input{}
-	err = json.Unmarshal(d, &load)
+	err := decodeJSON(r, &load)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
 	var user = UserPass{load.Username, load.Password}
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "not valid!")
+	t, valid := AuthenticateContext(r.Context(), user)
+	countLogin(valid)
+	if !valid {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserUsername(user.Username)
-	log.Println("Logging in:", t)
+	logger(r.Context()).Debug("logging in", "id", t.ID)
 
 	t.LastLogin = time.Now().Unix()
 	t.Active = 1
-	if UpdateUser(t) {
-		log.Println("User updated:", t)
+	if UpdateUserFieldsContext(r.Context(), t, []string{"lastlogin", "active"}) {
+		logger(r.Context()).Info("user logged in", "id", t.ID)
 	} else {
-		log.Println("Update failed:", t)
+		logger(r.Context()).Error("cannot update user", "id", t.ID)
 		rw.WriteHeader(http.StatusBadRequest)
 	}
 }
@@ -137,48 +126,28 @@ func LoginHandlerV2(rw http.ResponseWriter, r *http.Request) {
 //  400: BadRequest
 
 func LogoutHandlerV2(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var load = V2Input{}
-	err = json.Unmarshal(d, &load)
+	err := decodeJSON(r, &load)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
 	var user = UserPass{load.Username, load.Password}
-	err = json.Unmarshal(d, &user)
-	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
-		return
-	}
 
-	if !IsUserValid(user) {
-		log.Println("User", user.Username, "exists!")
+	if !IsUserValidContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid credentials", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	t := FindUserUsername(user.Username)
-	log.Println("Logging out:", t.Username)
-	t.Active = 0
-	if UpdateUser(t) {
-		log.Println("User updated:", t)
+	t := FindUserUsernameContext(r.Context(), user.Username)
+	logger(r.Context()).Debug("logging out", "id", t.ID)
+	err = logoutUser(r.Context(), t)
+	if err == nil {
+		logger(r.Context()).Info("user logged out", "id", t.ID)
 	} else {
-		log.Println("Update failed:", t)
+		logger(r.Context()).Error("cannot log out user", "id", t.ID, "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 	}
 }
@@ -187,41 +156,27 @@ func LogoutHandlerV2(rw http.ResponseWriter, r *http.Request) {
 // Get a list of all users
 //
 // responses:
-//	200: User
+//	200: UserView
 //  400: BadRequest
 
 func GetAllHandlerV2(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var load = V2Input{}
-	err = json.Unmarshal(d, &load)
+	err := decodeJSON(r, &load)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
 	var user = UserPass{load.Username, load.Password}
-	if !IsUserAdmin(user) {
-		log.Println("User", user, "does not exist!")
+	if !IsUserAdminContext(r.Context(), user) {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = SliceToJSON(ReturnAllUsers(), rw)
+	err = SliceToJSON(Views(ReturnAllUsersContext(r.Context())), rw)
 	if err != nil {
-		log.Println(err)
+		logger(r.Context()).Error("cannot write response", "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -231,42 +186,28 @@ func GetAllHandlerV2(rw http.ResponseWriter, r *http.Request) {
 // Get a list of all users
 //
 // responses:
-//	200: User
+//	200: UserView
 //  400: BadRequest
 
 // GetAllHandlerUpdated is for `/v1/getall`.
 // The older version had a bug as it was using `IsUserValid` instead of `IsUserAdmin`.
 func GetAllHandlerUpdated(rw http.ResponseWriter, r *http.Request) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return
-	}
-
-	if len(d) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		log.Println("No input!")
-		return
-	}
-
 	var user = UserPass{}
-	err = json.Unmarshal(d, &user)
+	err := decodeJSON(r, &user)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeBodyError(rw, r, err)
 		return
 	}
 
-	if !IsUserAdmin(user) {
-		log.Println("User", user, "is not Admin!")
+	if !IsUserAdminContext(r.Context(), user) {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", user.Username)
 		rw.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	err = SliceToJSON(ReturnAllUsers(), rw)
+	err = SliceToJSON(Views(ReturnAllUsersContext(r.Context())), rw)
 	if err != nil {
-		log.Println(err)
+		logger(r.Context()).Error("cannot write response", "err", err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -283,63 +224,136 @@ func GetAllHandlerUpdated(rw http.ResponseWriter, r *http.Request) {
 func UploadFile(rw http.ResponseWriter, r *http.Request) {
 	filename, ok := mux.Vars(r)["filename"]
 	if !ok {
-		log.Println("filename value not set!")
+		logger(r.Context()).Info("filename not set")
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
-	log.Println(filename)
+	logger(r.Context()).Debug("uploading file", "filename", filename)
 	saveFile(IMAGESPATH+"/"+filename, rw, r)
 }
 
 func saveFile(path string, rw http.ResponseWriter, r *http.Request) {
-	log.Println("Saving to", path)
-	err := saveToFile(path, r.Body)
+	logger(r.Context()).Debug("saving file", "path", path)
+	err := saveToFile(r.Context(), path, r.Body)
 	if err != nil {
-		log.Println(err)
+		logger(r.Context()).Error("cannot save file", "path", path, "err", err)
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
 		return
 	}
 }
 
-func saveToFile(path string, contents io.Reader) error {
-	_, err := os.Stat(path)
-	if err == nil {
-		err = os.Remove(path)
-		if err != nil {
-			log.Println("Error deleting", path)
-			return err
-		}
-	} else if !os.IsNotExist(err) {
-		log.Println("Unexpected error:", err)
+// uploadPrefix is the prefix of the temporary files of uploads in progress
+const uploadPrefix = ".upload-"
+
+// saveToFile writes contents to a temporary file next to path and renames
+// it to path when the upload is complete, so interrupted uploads never
+// replace an existing file
+func saveToFile(ctx context.Context, path string, contents io.Reader) (err error) {
+	ctx, span := tracer().Start(ctx, "saveToFile",
+		trace.WithAttributes(attribute.String("file.path", path)))
+	defer func() {
+		traceError(ctx, err)
+		span.End()
+	}()
+
+	_, err = os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		logger(ctx).Error("cannot stat file", "path", path, "err", err)
 		return err
 	}
 
 	// If everything is OK, create the file
-	f, err := os.Create(path)
+	f, err := os.CreateTemp(filepath.Dir(path), uploadPrefix+"*")
 	if err != nil {
-		log.Println(err)
+		logger(ctx).Error("cannot create file", "err", err)
 		return err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	n, err := io.Copy(f, contents)
 	if err != nil {
 		return err
 	}
-	log.Println("Bytes written:", n)
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		logger(ctx).Error("cannot rename file", "path", f.Name(), "err", err)
+		return err
+	}
+	uploadBytes.Add(float64(n))
+	span.SetAttributes(attribute.Int64("file.size", n))
+	logger(ctx).Info("file saved", "path", path, "bytes", n)
 	return nil
 }
 
+// StaleUploads returns the temporary files of uploads in directory d
+// that have not been modified for longer than age. These are left behind
+// when the server stops in the middle of an upload.
+func StaleUploads(d string, age time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(d)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []string{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), uploadPrefix) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if time.Since(info.ModTime()) >= age {
+			stale = append(stale, filepath.Join(d, e.Name()))
+		}
+	}
+	return stale, nil
+}
+
+// CleanupUploads deletes the files returned by StaleUploads
+// and returns the paths of the deleted files
+func CleanupUploads(d string, age time.Duration) ([]string, error) {
+	stale, err := StaleUploads(d, age)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []string{}
+	for _, path := range stale {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, path)
+	}
+	return deleted, nil
+}
+
 func CreateImageDirectory(d string) error {
 	_, err := os.Stat(d)
 	if os.IsNotExist(err) {
-		log.Println("Creating:", d)
+		slog.Info("creating directory", "path", d)
 		err = os.MkdirAll(d, 0755)
 		if err != nil {
-			log.Println(err)
+			slog.Error("cannot create directory", "err", err)
 			return err
 		}
 	} else if err != nil {
-		log.Println(err)
+		slog.Error("cannot create directory", "err", err)
 		return err
 	}
 
@@ -352,19 +366,15 @@ func CreateImageDirectory(d string) error {
 	return nil
 }
 
-func MiddleWare(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Serving %s from %s using %s method", r.RequestURI, r.Host, r.Method)
-		next.ServeHTTP(w, r)
-	})
-}
-
 // Generating Random Strings with a Given length
 func random(min, max int) int {
 	return rand.Intn(max-min) + min
 }
 
 // RandomPassword generates random strings of given length
+//
+// Deprecated: the strings come from math/rand and can be guessed,
+// use NewPassword for passwords.
 func RandomPassword(l int) string {
 	Password := ""
 	rand.Seed(time.Now().Unix())
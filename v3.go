@@ -0,0 +1,742 @@
+package shandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// V3Error defines the body that is returned by V3 of the REST API
+// when a request fails
+// swagger:model V3Error
+type V3Error struct {
+	// Description of the error
+	//
+	// required: true
+	Error string `json:"error"`
+	// The ID of the request, to be quoted when reporting the error
+	//
+	// required: false
+	RequestID string `json:"request_id,omitempty"`
+	// The fields that are not valid, when the status is 403 or 422
+	//
+	// required: false
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// V3Token defines the body that is returned when a new session is created
+// swagger:model V3Token
+type V3Token struct {
+	// The token that should be sent as "Authorization: Bearer <token>"
+	//
+	// required: true
+	Token string `json:"token"`
+	// The expiration time of the token
+	//
+	// required: true
+	Expires int64 `json:"expires"`
+}
+
+// UserPatch documents the JSON Merge Patch body of PATCH /v3/users/{id}.
+// Fields that are not present are not changed.
+// swagger:model UserPatch
+type UserPatch struct {
+	// The new Username of the User
+	//
+	// required: false
+	Username *string `json:"user"`
+	// The new Password of the User
+	//
+	// required: false
+	Password *string `json:"password"`
+	// The new Email address of the User, an empty string removes it
+	//
+	// required: false
+	Email *string `json:"email"`
+	// Is the User Admin or not
+	//
+	// required: false
+	Admin *int `json:"admin"`
+	// The profile Attributes of the User, merged with the current ones
+	//
+	// required: false
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// PasswordChange defines the body of PUT /v3/users/{id}/password
+// swagger:model PasswordChange
+type PasswordChange struct {
+	// The Password that the User has now
+	//
+	// required: true
+	CurrentPassword string `json:"current_password" validate:"required"`
+	// The Password that replaces it
+	//
+	// required: true
+	// min length: 8
+	// max length: 72
+	NewPassword string `json:"new_password" validate:"required,min=8,maxbytes=72,nefield=CurrentPassword"`
+}
+
+// Validate checks the fields of a PasswordChange
+func (p *PasswordChange) Validate() error {
+	return validateStruct(p)
+}
+
+// RegisterV3Routes adds the routes of V3 of the REST API to r
+func RegisterV3Routes(r *mux.Router) {
+	r.HandleFunc("/v3/users", ListUsersHandlerV3).Methods(http.MethodGet)
+	r.HandleFunc("/v3/users", CreateUserHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/users/batch", BatchHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/users/export", ExportHandlerV3).Methods(http.MethodGet)
+	r.HandleFunc("/v3/users/import", ImportHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/users/attributes-schema", AttributesSchemaHandlerV3).Methods(http.MethodGet)
+	r.HandleFunc("/v3/users/{id:[0-9]+}", GetUserHandlerV3).Methods(http.MethodGet)
+	r.HandleFunc("/v3/users/{id:[0-9]+}", PatchUserHandlerV3).Methods(http.MethodPatch)
+	r.HandleFunc("/v3/users/{id:[0-9]+}", DeleteUserHandlerV3).Methods(http.MethodDelete)
+	r.HandleFunc("/v3/users/{id:[0-9]+}/password", ChangePasswordHandlerV3).Methods(http.MethodPut)
+	r.HandleFunc("/v3/users/{id:[0-9]+}/email-verification", RequestEmailVerificationHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/sessions", CreateSessionHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/sessions", DeleteSessionHandlerV3).Methods(http.MethodDelete)
+	r.HandleFunc("/v3/password-resets", RequestPasswordResetHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/password-resets/confirm", ConfirmPasswordResetHandlerV3).Methods(http.MethodPost)
+	r.HandleFunc("/v3/email-verifications/confirm", ConfirmEmailVerificationHandlerV3).Methods(http.MethodPost)
+}
+
+// writeJSON writes v as the JSON body of the response
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	err := json.NewEncoder(rw).Encode(v)
+	if err != nil {
+		slog.Error("cannot write response", "err", err)
+	}
+}
+
+// writeError writes a V3Error as the body of the response.
+// The request ID is taken from the header that RequestIDMiddleWare sets.
+func writeError(rw http.ResponseWriter, status int, msg string) {
+	writeJSON(rw, status, V3Error{Error: msg, RequestID: rw.Header().Get(RequestIDHeader)})
+}
+
+// writePreconditionError writes the V3Error of a failed If-Match check
+func writePreconditionError(rw http.ResponseWriter, status int) {
+	if status == http.StatusPreconditionRequired {
+		writeError(rw, status, "If-Match header required")
+		return
+	}
+	writeError(rw, status, "user record has been modified")
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return empty, false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// authenticate returns the User that issued the request.
+// Both session tokens and HTTP Basic authentication are supported.
+func authenticate(r *http.Request) (User, bool) {
+	if token, ok := bearerToken(r); ok {
+		s, ok := FindSessionContext(r.Context(), token)
+		if !ok {
+			return User{}, false
+		}
+		u := FindUserIDContext(r.Context(), s.UserID)
+		setRequestUser(r.Context(), u.Username)
+		return u, u.Username != empty
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return User{}, false
+	}
+	u, valid := AuthenticateContext(r.Context(), UserPass{username, password})
+	countLogin(valid)
+	return u, valid
+}
+
+// requireUser authenticates the request and writes a 401 response
+// when that fails
+func requireUser(rw http.ResponseWriter, r *http.Request) (User, bool) {
+	u, ok := authenticate(r)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="shandler", Bearer`)
+		writeError(rw, http.StatusUnauthorized, "authentication required")
+		return User{}, false
+	}
+	return u, true
+}
+
+// requireAdmin authenticates the request and writes a 401 or 403
+// response when the caller is not an administrator
+func requireAdmin(rw http.ResponseWriter, r *http.Request) (User, bool) {
+	u, ok := requireUser(rw, r)
+	if !ok {
+		return User{}, false
+	}
+	if u.Admin != 1 {
+		logger(r.Context()).Warn("command issued by non-admin user", "username", u.Username)
+		writeError(rw, http.StatusForbidden, "administrator privileges required")
+		return User{}, false
+	}
+	return u, true
+}
+
+// userFromPath returns the User defined by the {id} of the path
+// and writes a 400 or 404 response when that fails
+func userFromPath(rw http.ResponseWriter, r *http.Request) (User, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger(r.Context()).Info("invalid user ID", "err", err)
+		writeError(rw, http.StatusBadRequest, "invalid user id")
+		return User{}, false
+	}
+
+	t := FindUserIDContext(r.Context(), id)
+	if t.Username == empty {
+		logger(r.Context()).Info("user not found", "id", id)
+		writeError(rw, http.StatusNotFound, "user not found")
+		return User{}, false
+	}
+	return t, true
+}
+
+// applyUserChanges copies the fields that u sets to t. The exists
+// function reports whether a username or an email address, depending on
+// field, belongs to another user.
+// It returns the sorted names of the changed fields, or the HTTP status
+// code and the message that describe why the changes are not valid.
+func applyUserChanges(t *User, u UserUpdate, exists func(field, value string) bool) ([]string, int, string) {
+	if u.Username != nil {
+		if exists("user", *u.Username) {
+			return nil, http.StatusConflict, "user already exists"
+		}
+		t.Username = *u.Username
+	}
+	if u.Password != nil {
+		t.Password = *u.Password
+	}
+	if u.Email != nil {
+		if *u.Email != empty && exists("email", *u.Email) {
+			return nil, http.StatusConflict, "email already exists"
+		}
+		t.Email = *u.Email
+	}
+	if u.Admin != nil {
+		t.Admin = *u.Admin
+	}
+	if u.Attributes != nil {
+		t.Attributes = u.Attributes
+	}
+	return u.fields(), 0, empty
+}
+
+// swagger:route GET /v3/users users listUsersV3
+// Get a list of all users.
+// Parameters such as attributes.department=Sales only return the users
+// whose attributes have these values.
+//
+// responses:
+//	200: UserView
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+
+// ListUsersHandlerV3 returns all users and requires an administrator
+func ListUsersHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(rw, r); !ok {
+		return
+	}
+
+	filters := map[string]string{}
+	for k, v := range r.URL.Query() {
+		name := strings.TrimPrefix(k, "attributes.")
+		if name == k {
+			continue
+		}
+		if _, err := attributePath(name); err != nil {
+			writeError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		filters[name] = v[0]
+	}
+	if len(filters) == 0 {
+		writeJSON(rw, http.StatusOK, Views(ReturnAllUsersContext(r.Context())))
+		return
+	}
+
+	users, err := FindUsersAttributesContext(r.Context(), filters)
+	if err != nil {
+		logger(r.Context()).Error("cannot find users", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot list users")
+		return
+	}
+	writeJSON(rw, http.StatusOK, Views(users))
+}
+
+// swagger:route POST /v3/users users createUserV3
+// Create a new user
+//
+// responses:
+//	201: UserView
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+//	409: V3Error
+//	422: V3Error
+
+// CreateUserHandlerV3 creates a new user and requires an administrator
+func CreateUserHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireAdmin(rw, r)
+	if !ok {
+		return
+	}
+
+	var in = userCreateBody{}
+	err := decodeJSON(r, &in)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	err = checkWritable(caller.Role(), in.fields())
+	if err != nil {
+		writePermissionError(rw, r, err)
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	if FindUserUsernameContext(r.Context(), in.Username).Username != empty {
+		writeError(rw, http.StatusConflict, "user already exists")
+		return
+	}
+	if in.Email != empty && FindUserEmailContext(r.Context(), in.Email).Username != empty {
+		writeError(rw, http.StatusConflict, "email already exists")
+		return
+	}
+
+	if !AddUserContext(r.Context(), in.NewUser()) {
+		writeError(rw, http.StatusInternalServerError, "cannot create user")
+		return
+	}
+
+	t := FindUserUsernameContext(r.Context(), in.Username)
+	rw.Header().Set("Location", "/v3/users/"+strconv.Itoa(t.ID))
+	rw.Header().Set("ETag", ETag(t))
+	writeJSON(rw, http.StatusCreated, t.View())
+}
+
+// swagger:route GET /v3/users/{id} users getUserV3
+// Get the record of a user
+//
+// responses:
+//	200: UserView
+//	304: OK
+//	401: V3Error
+//	403: V3Error
+//	404: V3Error
+
+// GetUserHandlerV3 returns a single user.
+// Administrators can read any user, other users can only read themselves.
+func GetUserHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(rw, r)
+	if !ok {
+		return
+	}
+
+	t, ok := userFromPath(rw, r)
+	if !ok {
+		return
+	}
+
+	if caller.Admin != 1 && caller.ID != t.ID {
+		writeError(rw, http.StatusForbidden, "administrator privileges required")
+		return
+	}
+
+	rw.Header().Set("ETag", ETag(t))
+	if notModified(r, t) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(rw, http.StatusOK, t.View())
+}
+
+// swagger:route PATCH /v3/users/{id} users patchUserV3
+// Update some fields of a user.
+// The body is a JSON Merge Patch (application/merge-patch+json)
+// or a JSON Patch (application/json-patch+json) document.
+//
+// consumes:
+//	- application/merge-patch+json
+//	- application/json-patch+json
+//	- application/json
+//
+// responses:
+//	200: UserView
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+//	404: V3Error
+//	409: V3Error
+//	412: V3Error
+//	415: V3Error
+//	422: V3Error
+//	428: V3Error
+
+// PatchUserHandlerV3 changes only the fields of a user that are
+// modified by the patch document. Administrators change every user,
+// and users change the fields of their own record that their role can
+// write. A new password logs the user out of the other sessions.
+func PatchUserHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(rw, r)
+	if !ok {
+		return
+	}
+
+	t, ok := userFromPath(rw, r)
+	if !ok {
+		return
+	}
+
+	if caller.Admin != 1 && caller.ID != t.ID {
+		writeError(rw, http.StatusForbidden, "administrator privileges required")
+		return
+	}
+
+	version, status := ifMatch(r, t)
+	if status != 0 {
+		writePreconditionError(rw, status)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case MergePatchType, JSONPatchType, "application/json", empty:
+	default:
+		writeError(rw, http.StatusUnsupportedMediaType, "unsupported patch format "+contentType)
+		return
+	}
+
+	var d json.RawMessage
+	err := decodeJSON(r, &d)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	changed, err := PatchUserDocument(t, contentType, d)
+	if err != nil {
+		logger(r.Context()).Info("cannot apply patch", "err", err)
+		var bad *bodyError
+		if errors.As(err, &bad) {
+			writeError(rw, bad.status, bad.msg)
+		} else if err == ErrPatchTestFailed {
+			writeError(rw, http.StatusConflict, err.Error())
+		} else {
+			writeError(rw, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+
+	err = checkWritable(caller.Role(), changedFields(changed))
+	if err != nil {
+		writePermissionError(rw, r, err)
+		return
+	}
+	update, err := newUserUpdate(changed)
+	if err != nil {
+		writeError(rw, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	fields, status, msg := applyUserChanges(&t, update, func(field, value string) bool {
+		if field == "email" {
+			u := FindUserEmailContext(r.Context(), value)
+			return u.Username != empty && u.ID != t.ID
+		}
+		return FindUserUsernameContext(r.Context(), value).Username != empty
+	})
+	if status != 0 {
+		writeError(rw, status, msg)
+		return
+	}
+
+	err = validateChanges(t, fields)
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	if len(fields) != 0 {
+		err = updateUser(r.Context(), t, fields, version)
+		if err == ErrVersionMismatch {
+			writePreconditionError(rw, http.StatusPreconditionFailed)
+			return
+		} else if err != nil {
+			logger(r.Context()).Error("cannot update user", "id", t.ID, "err", err)
+			writeError(rw, http.StatusInternalServerError, "cannot update user")
+			return
+		}
+		if update.Password != nil {
+			passwordChanged(r, caller, t.ID)
+		}
+		t = FindUserIDContext(r.Context(), t.ID)
+	}
+
+	rw.Header().Set("ETag", ETag(t))
+	writeJSON(rw, http.StatusOK, t.View())
+}
+
+// swagger:route DELETE /v3/users/{id} users deleteUserV3
+// Delete a user
+//
+// responses:
+//	204: OK
+//	401: V3Error
+//	403: V3Error
+//	404: V3Error
+//	412: V3Error
+//	428: V3Error
+
+// DeleteUserHandlerV3 deletes a user and its sessions
+// and requires an administrator
+func DeleteUserHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(rw, r); !ok {
+		return
+	}
+
+	t, ok := userFromPath(rw, r)
+	if !ok {
+		return
+	}
+
+	version, status := ifMatch(r, t)
+	if status != 0 {
+		writePreconditionError(rw, status)
+		return
+	}
+
+	logger(r.Context()).Debug("deleting user", "id", t.ID)
+	err := deleteUser(r.Context(), t.ID, version)
+	if err == ErrVersionMismatch {
+		writePreconditionError(rw, http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot delete user", "id", t.ID, "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot delete user")
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route PUT /v3/users/{id}/password users changePasswordV3
+// Change the password of the caller, who has to send the current one.
+// The other sessions of the user are deleted.
+//
+// responses:
+//	204: OK
+//	400: V3Error
+//	401: V3Error
+//	403: V3Error
+//	404: V3Error
+//	412: V3Error
+//	415: V3Error
+//	422: V3Error
+//	428: V3Error
+
+// revokeCredentials deletes the sessions of a user whose password has
+// changed, apart from the session of token, and the password reset tokens
+// of the user. It returns the number of deleted sessions.
+func revokeCredentials(ctx context.Context, userID int, token string) int64 {
+	revoked, err := DeleteOtherSessionsContext(ctx, userID, token)
+	if err != nil {
+		logger(ctx).Error("cannot delete sessions", "id", userID, "err", err)
+	}
+	err = DeletePasswordResetsContext(ctx, userID)
+	if err != nil {
+		logger(ctx).Error("cannot delete password resets", "id", userID, "err", err)
+	}
+	return revoked
+}
+
+// passwordChanged revokes the credentials of a user whose password an
+// administrator has set and writes the audit event. Administrators that
+// change their own password keep the session of r.
+func passwordChanged(r *http.Request, caller User, userID int) {
+	token := empty
+	if caller.ID == userID {
+		token, _ = bearerToken(r)
+	}
+	revoked := revokeCredentials(r.Context(), userID, token)
+	audit(r.Context(), AuditPasswordChanged, "user_id", userID, "by", caller.ID, "sessions_revoked", revoked)
+}
+
+// ChangePasswordHandlerV3 lets users change their own password.
+// Administrators change the passwords of others with PATCH.
+func ChangePasswordHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(rw, r)
+	if !ok {
+		return
+	}
+
+	t, ok := userFromPath(rw, r)
+	if !ok {
+		return
+	}
+
+	if caller.ID != t.ID {
+		logger(r.Context()).Warn("password change of another user", "id", t.ID)
+		writeError(rw, http.StatusForbidden, "users can only change their own password")
+		return
+	}
+
+	version, status := ifMatch(r, t)
+	if status != 0 {
+		writePreconditionError(rw, status)
+		return
+	}
+
+	var in = PasswordChange{}
+	err := decodeJSON(r, &in)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	if !CheckPassword(t.Password, in.CurrentPassword) {
+		audit(r.Context(), AuditPasswordChangeFailed, "user_id", t.ID)
+		writeError(rw, http.StatusForbidden, "current password is not correct")
+		return
+	}
+
+	// The rules of User apply to the new password, under its name in the body
+	t.Password = in.NewPassword
+	err = validateChanges(t, []string{"password"})
+	if err != nil {
+		v := ValidationError{}.add(empty, err)
+		for i := range v {
+			v[i].Field = "new_password"
+		}
+		writeValidationError(rw, r, v)
+		return
+	}
+
+	err = updateUser(r.Context(), t, []string{"password"}, version)
+	if err == ErrVersionMismatch {
+		writePreconditionError(rw, http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot update user", "id", t.ID, "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot change password")
+		return
+	}
+
+	// The session of the request stays valid, so that the client
+	// that changed the password is not logged out
+	token, _ := bearerToken(r)
+	revoked := revokeCredentials(r.Context(), t.ID, token)
+	audit(r.Context(), AuditPasswordChanged, "user_id", t.ID, "sessions_revoked", revoked)
+
+	t = FindUserIDContext(r.Context(), t.ID)
+	rw.Header().Set("ETag", ETag(t))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route POST /v3/sessions sessions createSessionV3
+// Log in and create a new session
+//
+// responses:
+//	201: V3Token
+//	400: V3Error
+//	401: V3Error
+
+// CreateSessionHandlerV3 logs in a user and returns a session token
+func CreateSessionHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	var user = UserPass{}
+	err := decodeJSON(r, &user)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	t, valid := AuthenticateContext(r.Context(), user)
+	countLogin(valid)
+	if !valid {
+		logger(r.Context()).Warn("invalid username or password", "username", user.Username)
+		writeError(rw, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	token, s, err := CreateSessionContext(r.Context(), t.ID)
+	if err != nil {
+		logger(r.Context()).Error("cannot create session", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot create session")
+		return
+	}
+
+	t.LastLogin = time.Now().Unix()
+	t.Active = 1
+	if !UpdateUserFieldsContext(r.Context(), t, []string{"lastlogin", "active"}) {
+		logger(r.Context()).Error("cannot update user", "id", t.ID)
+	}
+	writeJSON(rw, http.StatusCreated, V3Token{Token: token, Expires: s.Expires})
+}
+
+// swagger:route DELETE /v3/sessions sessions deleteSessionV3
+// Log out and delete the current session
+//
+// responses:
+//	204: OK
+//	401: V3Error
+
+// DeleteSessionHandlerV3 logs out the user of the current session
+func DeleteSessionHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		writeError(rw, http.StatusUnauthorized, "session token required")
+		return
+	}
+
+	s, ok := FindSessionContext(r.Context(), token)
+	if !ok {
+		writeError(rw, http.StatusUnauthorized, "invalid session")
+		return
+	}
+
+	DeleteSessionContext(r.Context(), token)
+	t := FindUserIDContext(r.Context(), s.UserID)
+	if t.Username != empty {
+		err := logoutUser(r.Context(), t)
+		if err != nil {
+			logger(r.Context()).Error("cannot log out user", "id", t.ID, "err", err)
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
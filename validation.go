@@ -0,0 +1,239 @@
+package shandler
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator"
+)
+
+// Violation describes a field of a request that is not valid
+// swagger:model Violation
+type Violation struct {
+	// The JSON path of the field, such as load.user
+	//
+	// required: true
+	Field string `json:"field"`
+	// The rule that the field breaks, such as required or username
+	//
+	// required: true
+	Rule string `json:"rule"`
+	// Description of the problem
+	//
+	// required: true
+	Message string `json:"message"`
+}
+
+// ValidationError holds every Violation of a request, so that clients
+// can fix all of them at once
+type ValidationError []Violation
+
+// Error implements error
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, violation := range v {
+		msgs[i] = violation.Field + ": " + violation.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add appends the violations of err, which a Validate method returned,
+// with their fields under prefix, such as "load." or "[1]."
+func (v ValidationError) add(prefix string, err error) ValidationError {
+	if err == nil {
+		return v
+	}
+	var ve ValidationError
+	if !errors.As(err, &ve) {
+		return append(v, Violation{Field: strings.TrimSuffix(prefix, "."), Rule: "invalid", Message: err.Error()})
+	}
+	for _, violation := range ve {
+		violation.Field = prefix + violation.Field
+		v = append(v, violation)
+	}
+	return v
+}
+
+// usernamePattern is the format of new usernames: 3 to 32 letters,
+// digits, dots, underscores and hyphens that start with a letter or digit
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{2,31}$`)
+
+// validUsername returns true when username can be given to a new user
+func validUsername(username string) bool {
+	return usernamePattern.MatchString(username)
+}
+
+// userRules are the rules of User that involve more than one field
+func userRules(sl validator.StructLevel) {
+	u := sl.Current().Interface().(User)
+	if u.Active == 1 && u.LastLogin == 0 {
+		sl.ReportError(u.LastLogin, "lastlogin", "LastLogin", "active_login", empty)
+	}
+}
+
+// validate checks the validate tags of the models
+var validate = newValidator()
+
+// newValidator returns a validator that reports fields by their JSON names
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return empty
+		}
+		return name
+	})
+	v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return validUsername(fl.Field().String())
+	})
+	// Passwords are limited in bytes, because bcrypt ignores the bytes
+	// after the first 72
+	v.RegisterValidation("maxbytes", func(fl validator.FieldLevel) bool {
+		n, err := strconv.Atoi(fl.Param())
+		return err == nil && len(fl.Field().String()) <= n
+	})
+	v.RegisterStructValidation(userRules, User{})
+	return v
+}
+
+// snakeCase turns the name of a Go field, such as CurrentPassword,
+// into the style of the JSON names: current_password
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		if unicode.IsUpper(c) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// violationMessage describes the rule of e in words
+func violationMessage(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "username":
+		return "must be 3 to 32 letters, digits, '.', '_' or '-' and start with a letter or digit"
+	case "required_without":
+		return "is required when " + snakeCase(e.Param()) + " is not set"
+	case "email":
+		return "must be an email address"
+	case "oneof":
+		return "must be " + strings.ReplaceAll(e.Param(), " ", " or ")
+	case "gte":
+		return "must be at least " + e.Param()
+	case "min":
+		return "must be at least " + e.Param() + " characters"
+	case "max":
+		return "must be at most " + e.Param() + " characters"
+	case "maxbytes":
+		return "must be at most " + e.Param() + " bytes"
+	case "nefield":
+		return "must be different from " + snakeCase(e.Param())
+	case "active_login":
+		return "must be set when active is 1"
+	}
+	return "breaks the " + e.Tag() + " rule"
+}
+
+// validateStruct checks the validate tags of s and returns a
+// ValidationError with every violation, or nil
+func validateStruct(s interface{}) error {
+	err := validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		return err
+	}
+
+	v := ValidationError{}
+	for _, e := range fieldErrors {
+		// The namespace starts with the name of the Go type
+		field := e.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		v = append(v, Violation{Field: field, Rule: e.Tag(), Message: violationMessage(e)})
+	}
+	return v
+}
+
+// Validate checks the fields of a User and its attributes
+func (p *User) Validate() error {
+	v := ValidationError{}.add(empty, validateStruct(p)).add(empty, validateAttributes(p.Attributes))
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// validateChanges checks the fields of t that an update changes, so that
+// records that predate a rule can still be updated. The violations of
+// attributes.phone belong to the attributes field.
+func validateChanges(t User, fields []string) error {
+	err := t.Validate()
+	if err == nil {
+		return nil
+	}
+
+	changed := ValidationError{}
+	for _, v := range (ValidationError{}).add(empty, err) {
+		for _, f := range fields {
+			if v.Field == f || strings.HasPrefix(v.Field, f+".") {
+				changed = append(changed, v)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return changed
+}
+
+// ValidatePassword checks password against the rules of the passwords of u
+func ValidatePassword(u User, password string) error {
+	u.Password = password
+	return validateChanges(u, []string{"password"})
+}
+
+// Validate checks the fields of an Input
+func (p *Input) Validate() error {
+	return validateStruct(p)
+}
+
+// Validate checks the credentials of a V2Input. The user of the
+// command is checked separately, since only some commands have one.
+func (p *V2Input) Validate() error {
+	return validateStruct(p)
+}
+
+// Validate method validates the data of UserPass
+func (p *UserPass) Validate() error {
+	return validateStruct(p)
+}
+
+// writeValidationError writes the violations of err with
+// 422 Unprocessable Entity
+func writeValidationError(rw http.ResponseWriter, r *http.Request, err error) {
+	logger(r.Context()).Info("validation failed", "err", err)
+	v := ValidationError{}.add(empty, err)
+	writeJSON(rw, http.StatusUnprocessableEntity, V3Error{
+		Error:      "validation failed",
+		RequestID:  rw.Header().Get(RequestIDHeader),
+		Violations: v,
+	})
+}
@@ -0,0 +1,53 @@
+package shandler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPasswordRules(t *testing.T) {
+	u := User{ID: 2, Username: "alice", Password: "alice-secret"}
+	passwords := []struct {
+		password, rule, message string
+	}{
+		{"secret", "min", "must be at least 8 characters"},
+		{strings.Repeat("é", 37), "maxbytes", "must be at most 72 bytes"},
+		{"alice", "min", "must be at least 8 characters"},
+		{"alice-ok", empty, empty},
+		{strings.Repeat("é", 36), empty, empty},
+	}
+	for _, p := range passwords {
+		err := ValidatePassword(u, p.password)
+		if p.rule == empty {
+			if err != nil {
+				t.Errorf("%q: %v", p.password, err)
+			}
+			continue
+		}
+		v, ok := err.(ValidationError)
+		if !ok || len(v) == 0 || v[0].Rule != p.rule || v[0].Message != p.message {
+			t.Errorf("%q: %v, want %s %q", p.password, err, p.rule, p.message)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	h := newTestServer(t)
+
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"short"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusUnprocessableEntity)
+	rw = serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret"}`, "Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	alice := login(t, h, "alice", "alice-secret")
+	bodies := []string{
+		`{"current_password":"alice-secret","new_password":"short"}`,
+		`{"current_password":"alice-secret","new_password":"` + strings.Repeat("ü", 40) + `"}`,
+		`{"current_password":"alice-secret","new_password":"alice-secret"}`,
+	}
+	for _, body := range bodies {
+		rw = serve(h, http.MethodPut, "/v3/users/2/password", body, "Authorization", alice)
+		expectStatus(t, rw, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,244 @@
+package shandler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VERIFYTTL defines how long an email verification token remains valid
+var VERIFYTTL = 24 * time.Hour
+
+// VERIFYURL is the link of the email verification messages, where {token}
+// is replaced by the token. The token is sent on its own when it is empty.
+var VERIFYURL = empty
+
+// ErrInvalidVerificationToken is returned for email verification tokens
+// that do not exist, have expired, have already been used or belong to
+// an address that the user no longer has
+var ErrInvalidVerificationToken = errors.New("invalid or expired email verification token")
+
+// EmailVerificationConfirm defines the body of POST /v3/email-verifications/confirm
+// swagger:model EmailVerificationConfirm
+type EmailVerificationConfirm struct {
+	// The token of the email verification message
+	//
+	// required: true
+	Token string `json:"token" validate:"required"`
+}
+
+// Validate checks the fields of an EmailVerificationConfirm
+func (p *EmailVerificationConfirm) Validate() error {
+	return validateStruct(p)
+}
+
+// CreateEmailVerificationContext creates a token that verifies the current
+// email address of u and returns it with its expiration time. The earlier
+// tokens of the user stop working.
+func CreateEmailVerificationContext(ctx context.Context, u User) (string, int64, error) {
+	ctx, end := startOperation(ctx, "CreateEmailVerification", "create_email_verification")
+	defer end()
+
+	token, err := newToken(32)
+	if err != nil {
+		return empty, 0, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return empty, 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return empty, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE UserID = ?", u.ID)
+	if err != nil {
+		return empty, 0, err
+	}
+
+	now := time.Now()
+	expires := now.Add(VERIFYTTL).Unix()
+	_, err = tx.ExecContext(ctx, "INSERT INTO email_verifications(UserID, Email, Token, Created, Expires) values(?,?,?,?,?)",
+		u.ID, normalizeEmail(u.Email), hashToken(token), now.Unix(), expires)
+	if err != nil {
+		return empty, 0, err
+	}
+	return token, expires, tx.Commit()
+}
+
+// ConfirmEmailVerificationContext consumes an email verification token,
+// marks the address of its user as verified and returns the ID of the user.
+// The token only works while the user has the address it was sent to.
+func ConfirmEmailVerificationContext(ctx context.Context, token string) (int, error) {
+	ctx, end := startOperation(ctx, "ConfirmEmailVerification", "confirm_email_verification")
+	defer end()
+
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRowContext(ctx, "SELECT UserID, Email FROM email_verifications WHERE Token = ? AND Expires >= ?",
+		hashToken(token), time.Now().Unix()).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerificationToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE Token = ?", hashToken(token))
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET EmailVerified=1, Version=Version+1 WHERE ID = ? AND Email = ?",
+		userID, email)
+	if err != nil {
+		return 0, err
+	}
+	affect, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affect != 1 {
+		return 0, ErrInvalidVerificationToken
+	}
+	return userID, tx.Commit()
+}
+
+// DeleteExpiredEmailVerifications is for deleting the email verification
+// tokens that have expired
+func DeleteExpiredEmailVerifications() bool {
+	defer observeQuery("delete_expired_email_verifications")()
+
+	db, err := openDB()
+	if err != nil {
+		slog.Error("cannot open database", "err", err)
+		return false
+	}
+
+	_, err = db.Exec("DELETE FROM email_verifications WHERE Expires < ?", time.Now().Unix())
+	if err != nil {
+		slog.Error("cannot delete expired email verifications", "err", err)
+		return false
+	}
+	return true
+}
+
+// verificationMessage returns the message that delivers token to u
+func verificationMessage(u User, token string, expires int64) Message {
+	link := token
+	if VERIFYURL != empty {
+		link = strings.ReplaceAll(VERIFYURL, "{token}", token)
+	}
+	return Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: "Hello " + u.Username + ",\n\n" +
+			"Use the following to confirm that this is your email address:\n\n" + link + "\n\n" +
+			"It expires at " + time.Unix(expires, 0).UTC().Format(time.RFC1123) + ".\n" +
+			"If you do not have an account, you can ignore this message.",
+	}
+}
+
+// swagger:route POST /v3/users/{id}/email-verification users requestEmailVerificationV3
+// Send a verification token to the email address of a user.
+// Users can verify their own address, administrators every address.
+//
+// responses:
+//	202: OK
+//	401: V3Error
+//	403: V3Error
+//	404: V3Error
+//	409: V3Error
+
+// RequestEmailVerificationHandlerV3 sends an email verification message
+func RequestEmailVerificationHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(rw, r)
+	if !ok {
+		return
+	}
+
+	t, ok := userFromPath(rw, r)
+	if !ok {
+		return
+	}
+
+	if caller.Admin != 1 && caller.ID != t.ID {
+		writeError(rw, http.StatusForbidden, "administrator privileges required")
+		return
+	}
+	if t.Email == empty {
+		writeError(rw, http.StatusConflict, "user has no email address")
+		return
+	}
+	if t.EmailVerified == 1 {
+		writeError(rw, http.StatusConflict, "email address is already verified")
+		return
+	}
+
+	token, expires, err := CreateEmailVerificationContext(r.Context(), t)
+	if err != nil {
+		logger(r.Context()).Error("cannot create email verification", "id", t.ID, "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot send email verification")
+		return
+	}
+	audit(r.Context(), AuditEmailVerificationRequested, "user_id", t.ID)
+	notify(r.Context(), verificationMessage(t, token, expires))
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// swagger:route POST /v3/email-verifications/confirm users confirmEmailVerificationV3
+// Confirm an email address with a verification token
+//
+// responses:
+//	204: OK
+//	400: V3Error
+//	415: V3Error
+//	422: V3Error
+
+// ConfirmEmailVerificationHandlerV3 marks the email address of the user
+// of a verification token as verified
+func ConfirmEmailVerificationHandlerV3(rw http.ResponseWriter, r *http.Request) {
+	var in = EmailVerificationConfirm{}
+	err := decodeJSON(r, &in)
+	if err != nil {
+		logger(r.Context()).Info("invalid request body", "err", err)
+		writeError(rw, bodyErrorStatus(err), err.Error())
+		return
+	}
+	err = in.Validate()
+	if err != nil {
+		writeValidationError(rw, r, err)
+		return
+	}
+
+	id, err := ConfirmEmailVerificationContext(r.Context(), in.Token)
+	if err == ErrInvalidVerificationToken {
+		logger(r.Context()).Warn("invalid email verification token")
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		logger(r.Context()).Error("cannot confirm email verification", "err", err)
+		writeError(rw, http.StatusInternalServerError, "cannot verify email address")
+		return
+	}
+	audit(r.Context(), AuditEmailVerified, "user_id", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
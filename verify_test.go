@@ -0,0 +1,48 @@
+package shandler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestEmailVerification(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","email":"Alice@Example.com"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	token, _, err := CreateEmailVerificationContext(context.Background(), FindUserUsername("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = serve(h, http.MethodPost, "/v3/email-verifications/confirm", `{"token":"`+token+`"}`)
+	expectStatus(t, rw, http.StatusNoContent)
+	rw = serve(h, http.MethodPost, "/v3/email-verifications/confirm", `{"token":"`+token+`"}`)
+	expectStatus(t, rw, http.StatusBadRequest)
+
+	// A verified address can be used to log in
+	alice := login(t, h, "alice@example.com", "alice-secret")
+	rw = serve(h, http.MethodGet, "/v3/users/2", empty, "Authorization", alice)
+	expectStatus(t, rw, http.StatusOK)
+	var v UserView
+	decodeBody(t, rw, &v)
+	if v.Email != "alice@example.com" || v.EmailVerified != 1 {
+		t.Fatalf("user = %+v", v)
+	}
+}
+
+func TestV1UserDataHasNoEmail(t *testing.T) {
+	h := newTestServer(t)
+	rw := serve(h, http.MethodPost, "/v3/users", `{"user":"alice","password":"alice-secret","email":"alice@example.com"}`,
+		"Authorization", adminAuth)
+	expectStatus(t, rw, http.StatusCreated)
+
+	rw = serve(h, http.MethodGet, "/v1/username/2", empty)
+	expectStatus(t, rw, http.StatusOK)
+	var v map[string]interface{}
+	decodeBody(t, rw, &v)
+	if v["user"] != "alice" || hasKey(v, "email") {
+		t.Fatalf("user = %v", v)
+	}
+}